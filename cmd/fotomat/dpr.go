@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/die-net/fotomat/v2/format"
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+const (
+	// maxDPR is the largest device pixel ratio a request may ask for.
+	maxDPR = 4
+	// minDPRQuality is the lowest quality that a high DPR will reduce
+	// the default quality to.
+	minDPRQuality = 45
+	// hintedDPRSteps is how many steps per unit a hinted device pixel
+	// ratio is rounded to.
+	hintedDPRSteps = 2
+)
+
+// dprHints are the client hint headers that may carry a device pixel
+// ratio, in order of preference.
+var dprHints = []string{"Sec-CH-DPR", "DPR"}
+
+// hintedDPR returns the device pixel ratio from a request's client hint
+// headers, limited to 1 to maxDPR, or 0 if there isn't a usable one.
+// Unlike a DPR in the URL, a bad hint is ignored rather than refused.
+//
+// A hint isn't covered by a URL's signature, so it is rounded to the
+// nearest 1/hintedDPRSteps, leaving only a few sizes that a signed URL
+// can be made at, and letting those share the cache.
+func hintedDPR(header http.Header) float64 {
+	for _, name := range dprHints {
+		dpr, err := strconv.ParseFloat(header.Get(name), 64)
+		if err != nil || !(dpr > 0) || math.IsInf(dpr, 0) {
+			continue
+		}
+		dpr = math.Round(dpr*hintedDPRSteps) / hintedDPRSteps
+		return math.Max(1, math.Min(dpr, maxDPR))
+	}
+	return 0
+}
+
+// applyDPR multiplies o's Width and Height by dpr, reduced as needed to
+// keep them within -max_output_dimension.  Pixels are smaller on a high
+// DPR display, so compression artifacts are less visible, and unless a
+// quality was given, it is lowered to save bytes.
+func applyDPR(o *thumbnail.Options, dpr float64) {
+	if dpr <= 1 {
+		return
+	}
+
+	for _, dimension := range []int{o.Width, o.Height} {
+		if dimension > 0 && float64(dimension)*dpr > float64(*maxOutputDimension) {
+			dpr = float64(*maxOutputDimension) / float64(dimension)
+		}
+	}
+	if dpr <= 1 {
+		return
+	}
+
+	o.Width = scaleDimension(o.Width, dpr)
+	o.Height = scaleDimension(o.Height, dpr)
+
+	if o.Save.Quality == 0 {
+		o.Save.Quality = dprQuality(dpr)
+	}
+}
+
+// scaleDimension multiplies a Width or Height by dpr, leaving 0 (the
+// original size) alone.
+func scaleDimension(dimension int, dpr float64) int {
+	if dimension == 0 {
+		return 0
+	}
+	scaled := int(math.Round(float64(dimension) * dpr))
+	if scaled > *maxOutputDimension {
+		scaled = *maxOutputDimension
+	}
+	return scaled
+}
+
+// dprQuality returns the lossy quality to use for a DPR above 1:
+// 20 less than the default for each step in DPR, down to minDPRQuality.
+func dprQuality(dpr float64) int {
+	q := int(math.Round(format.DefaultQuality - 20*(dpr-1)))
+	if q < minDPRQuality {
+		q = minDPRQuality
+	}
+	return q
+}
@@ -2,19 +2,32 @@ package main
 
 import (
 	"flag"
+	"log"
 	"net/http"
 	"regexp"
 	"strconv"
 	"time"
 
+	"github.com/die-net/fotomat/v2/diskcache"
 	"github.com/die-net/fotomat/v2/format"
 	"github.com/die-net/fotomat/v2/thumbnail"
 )
 
 var (
+	abortGracePeriod      = flag.Duration("abort_grace_period", thumbnail.DefaultAbortGracePeriod, "How long an image aborted after -max_processing_duration has to stop before it is counted as stuck.")
+	animated              = flag.Bool("animated", false, "Keep every frame of animated GIF and WebP images, rather than just the first.")
+	background            = flag.String("background", "", "Color to pad images to exactly the requested size with, as hex RRGGBB or RRGGBBAA (\"\"=transparent, or white for images without transparency).")
+	allowHeif             = flag.Bool("allow_heif", false, "Allow HEIC and AVIF as input formats")
 	allowPdf              = flag.Bool("allow_pdf", false, "Allow PDF as an input format")
 	allowSvg              = flag.Bool("allow_svg", false, "Allow SVG as an input format")
 	allowTiff             = flag.Bool("allow_tiff", false, "Allow TIFF as an input format")
+	clientHints           = flag.Bool("client_hints", false, "Use the client's Sec-CH-DPR or DPR header as dpr if a URL doesn't give one, and ask for it with \"Accept-CH\".")
+	diskCacheBytes        = flag.Int64("disk_cache_bytes", 1<<30, "Maximum total size of thumbnails in -disk_cache_directory.")
+	diskCacheDirectory    = flag.String("disk_cache_directory", "", "Cache thumbnails in this directory, keeping them across restarts (\"\"=disable).")
+	heifEffort            = flag.Int("heif_effort", format.DefaultEffort, "CPU effort to spend making AVIF and HEIF images smaller (1-9).")
+	enlarge               = flag.Bool("enlarge", false, "Scale images larger than their original size to fill the requested size, up to -max_enlarge.")
+	fetchRetries          = flag.Int("fetch_retries", 2, "How many times to retry fetching an original image if its server can't be reached or answers 502, 503, or 504.")
+	fetchRetryBackoff     = flag.Duration("fetch_retry_backoff", 100*time.Millisecond, "Roughly how long to wait before the first retry of a fetch, doubling for each retry after.")
 	fetchTimeout          = flag.Duration("fetch_timeout", 30*time.Second, "How long to wait to receive original image from source (0=disable).")
 	localImageDirectory   = flag.String("local_image_directory", "", "Enable local image serving from this path (\"\"=proxy instead).")
 	lossless              = flag.Bool("lossless", true, "Allow saving as PNG even without transparency.")
@@ -22,74 +35,255 @@ var (
 	losslessWebp          = flag.Bool("lossless_webp", false, "When saving in WebP, allow lossless encoding.")
 	maxBufferPixels       = flag.Int("max_buffer_pixels", 6500000, "Maximum number of pixels to allocate for an intermediate image buffer.")
 	maxImageThreads       = flag.Int("max_image_threads", numCPUCores(), "Maximum number of threads simultaneously processing images (0=all CPUs).")
+	maxEnlarge            = flag.Float64("max_enlarge", thumbnail.DefaultMaxEnlarge, "Maximum factor to enlarge an image's width and height by, if enlarging (at least 1).")
+	maxFrames             = flag.Int("max_frames", 256, "Maximum number of frames in an animated image, if -animated (0=unlimited).")
+	maxOriginFetches      = flag.Int("max_origin_fetches", 0, "Maximum number of original images to fetch from one server at once (0=unlimited).")
+	maxOriginalBytes      = flag.Int64("max_original_bytes", 64<<20, "Maximum size of an original image to fetch (0=unlimited).")
 	maxOutputDimension    = flag.Int("max_output_dimension", 2048, "Maximum width or height of an image response.")
 	maxPrefetch           = flag.Int("max_prefetch", numCPUCores(), "Maximum number of images to prefetch before thread is available.")
-	maxProcessingDuration = flag.Duration("max_processing_duration", time.Minute, "Maximum duration we can be processing an image before assuming we crashed (0=disable).")
+	maxProcessingDuration = flag.Duration("max_processing_duration", time.Minute, "Maximum duration we can be processing an image before aborting it with 503 (0=disable).")
 	maxQueueDuration      = flag.Duration("max_queue_duration", 10*time.Second, "Maximum delay of pre-image-fetch queue before returning error (0=disable).")
+	maxStuck              = flag.Int("max_stuck", thumbnail.DefaultMaxStuck, "Exit, assuming we crashed, once this many images are stuck within -stuck_window.")
+	negotiateFormat       = flag.Bool("negotiate_format", false, "Use WebP or AVIF if the client's Accept header allows it, and add \"Vary: Accept\" to responses.")
+	originBreakerCooldown = flag.Duration("origin_breaker_cooldown", 10*time.Second, "How long to refuse requests for a server after -origin_breaker_failures.")
+	originBreakerFailures = flag.Int("origin_breaker_failures", 0, "Refuse requests for a server with 503 for -origin_breaker_cooldown after this many consecutive failed fetches from it (0=never).")
+	originalCacheBytes    = flag.Int64("original_cache_bytes", 0, "Keep up to this many bytes of recently fetched original images in memory, as their Cache-Control allows (0=disable).")
 	sharpen               = flag.Bool("sharpen", false, "Sharpen after resize.")
+	stuckWindow           = flag.Duration("stuck_window", thumbnail.DefaultStuckWindow, "How long a stuck image counts towards -max_stuck.")
 
-	matchPath = regexp.MustCompile(`^(/.*)=(p?)(w?)([sc])(\d{1,5})x(\d{1,5})$`)
+	matchPath = regexp.MustCompile(`^(/.*)=(p?)(w?)([scmeal])(\d{0,5})x(\d{0,5})(?:,(\d(?:\.\d{1,2})?)x)?(?:@([0-9a-z]+|[0-9.]+,[0-9.]+))?$`)
+
+	// padBackground is the parsed form of background, set by handleInit.
+	padBackground thumbnail.Color
+
+	// pathCropModes maps the crop operations in matchPath to CropModes.
+	pathCropModes = map[string]thumbnail.CropMode{
+		"c": thumbnail.CropTop,
+		"m": thumbnail.CropCentre,
+		"e": thumbnail.CropEntropy,
+		"a": thumbnail.CropAttention,
+	}
+
+	errBadRequest       = &thumbnail.StatusError{Status: http.StatusBadRequest}
+	errMissingDimension = &thumbnail.StatusError{Status: http.StatusBadRequest, Message: "crop and pad need both a width and a height"}
 )
 
-func handleInit() http.Handler {
-	pool := thumbnail.NewPool(*maxImageThreads, 1)
+func handleInit() *thumbnail.Proxy {
+	urlSigningKeys = parseSigningKeys(*signingKeys)
 
-	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
-	if *localImageDirectory != "" {
-		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(*localImageDirectory)))
+	if *background != "" {
+		var err error
+		if padBackground, err = parseColor(*background); err != nil {
+			log.Fatalf("Bad -background %q: %v", *background, err)
+		}
 	}
 
-	client := &http.Client{Transport: http.RoundTripper(transport), Timeout: *fetchTimeout}
+	var err error
+	if originRoutes, err = parseOriginMap(*originMap); err != nil {
+		log.Fatalf("Bad -origin_map: %v", err)
+	}
+	originHosts = parseHostList(*originAllowHosts)
+	if *originScheme != "http" && *originScheme != "https" {
+		log.Fatalf("Bad -origin_scheme %q: must be http or https", *originScheme)
+	}
+	allowedNetworks, err := parseNetworks(*allowOriginNetworks)
+	if err != nil {
+		log.Fatalf("Bad -allow_origin_networks: %v", err)
+	}
 
-	return thumbnail.NewProxy(director, pool, *maxPrefetch+*maxImageThreads, client)
-}
+	if trustedProxies, err = parseNetworks(*trustedProxyNetworks); err != nil {
+		log.Fatalf("Bad -trusted_proxy_networks: %v", err)
+	}
+	if (*priorityHeader != "" || *tenantHeader != "") && len(trustedProxies) == 0 {
+		log.Fatalf("-priority_header and -tenant_header need -trusted_proxy_networks")
+	}
 
-func director(req *http.Request) (thumbnail.Options, int) {
-	g := matchPath.FindStringSubmatch(req.URL.Path)
-	if len(g) != 7 {
-		return thumbnail.Options{}, http.StatusBadRequest
+	weights, err := parseTenantWeights(*tenantWeights)
+	if err != nil {
+		log.Fatalf("Bad -tenant_weights: %v", err)
 	}
 
-	if *localImageDirectory != "" {
-		req.URL.Scheme = "file"
-		req.URL.Host = "localhost"
-	} else {
-		req.URL.Scheme = "http"
-		req.URL.Host = req.Host
+	pool := thumbnail.NewPool(*maxImageThreads, 1)
+	for tenant, weight := range weights {
+		pool.SetTenantWeight(tenant, weight)
 	}
+	prometheusRegisterPool(pool)
 
-	req.URL.Path = g[1]
-	preview := g[2] == "p"
-	webp := g[3] == "w"
-	crop := g[4] == "c"
-	width, _ := strconv.Atoi(g[5])
-	height, _ := strconv.Atoi(g[6])
+	if *s3Bucket != "" && *localImageDirectory != "" {
+		log.Fatalf("Can't use both -s3_bucket and -local_image_directory")
+	}
+	origin, err := newOrigin(allowedNetworks, originRoutes, originTLS{caFile: *originCAFile, certFile: *originCertFile, keyFile: *originKeyFile})
+	if err != nil {
+		log.Fatalf("Bad origin TLS settings: %v", err)
+	}
 
-	// Disallow repeated scaling parameters.
-	if matchPath.MatchString(req.URL.Path) {
-		return thumbnail.Options{}, http.StatusBadRequest
+	proxy := thumbnail.NewProxyErr(director, pool, *maxPrefetch+*maxImageThreads, origin)
+	proxy.NegotiateFormat = *negotiateFormat
+	proxy.LosslessWebp = *losslessWebp
+	proxy.MaxOriginalBytes = *maxOriginalBytes
+	proxy.Retries = *fetchRetries
+	proxy.RetryBackoff = *fetchRetryBackoff
+	proxy.MaxOriginFetches = *maxOriginFetches
+	proxy.BreakerFailures = *originBreakerFailures
+	proxy.BreakerCooldown = *originBreakerCooldown
+	prometheusRegisterUpstreams(proxy)
+	if *diskCacheDirectory != "" {
+		cache, err := diskcache.New(*diskCacheDirectory, *diskCacheBytes)
+		if err != nil {
+			log.Fatalf("Can't use -disk_cache_directory: %v", err)
+		}
+		proxy.Cache = cache
+	}
+	if *originalCacheBytes > 0 {
+		proxy.Originals = thumbnail.NewOriginalCache(*originalCacheBytes)
+		prometheusRegisterOriginalCache(proxy.Originals)
+	}
+	if *clientHints {
+		proxy.ClientHints = dprHints
 	}
 
-	if width <= 0 || height <= 0 || width > *maxOutputDimension || height > *maxOutputDimension {
-		return thumbnail.Options{}, http.StatusBadRequest
+	return proxy
+}
+
+func director(req *http.Request) (thumbnail.Options, error) {
+	// Refuse unsigned requests before doing anything else.
+	if len(urlSigningKeys) > 0 {
+		if !validSignature(req.Host, req.URL, urlSigningKeys) {
+			return thumbnail.Options{}, &thumbnail.StatusError{Status: http.StatusForbidden}
+		}
+		stripSignature(req.URL)
 	}
 
 	o := thumbnail.Options{
-		Width:                 width,
-		Height:                height,
 		MaxBufferPixels:       *maxBufferPixels,
+		Background:            padBackground,
+		Enlarge:               *enlarge,
+		MaxEnlarge:            *maxEnlarge,
+		Animated:              *animated,
+		MaxFrames:             *maxFrames,
 		Sharpen:               *sharpen,
-		Crop:                  crop,
 		MaxQueueDuration:      *maxQueueDuration,
 		MaxProcessingDuration: *maxProcessingDuration,
+		AbortGracePeriod:      *abortGracePeriod,
+		MaxStuck:              *maxStuck,
+		StuckWindow:           *stuckWindow,
 		AllowPdf:              *allowPdf,
 		AllowSvg:              *allowSvg,
 		AllowTiff:             *allowTiff,
+		AllowHeif:             *allowHeif,
 		Save: format.SaveOptions{
+			Effort:       *heifEffort,
 			Lossless:     *lossless,
 			LossyIfPhoto: *lossyIfPhoto,
 		},
 	}
+	o.Priority, o.Tenant = requestSchedule(req)
+
+	// Scaling parameters are either a suffix on the path or, failing
+	// that, the query string.
+	var dpr float64
+	if g := matchPath.FindStringSubmatch(req.URL.Path); g != nil {
+		req.URL.Path = g[1]
+		var err error
+		if dpr, err = pathOptions(g, &o); err != nil {
+			return thumbnail.Options{}, err
+		}
+	} else if req.URL.RawQuery != "" {
+		var err error
+		if dpr, err = queryOptions(req.URL.Query(), &o); err != nil {
+			return thumbnail.Options{}, err
+		}
+		req.URL.RawQuery = ""
+	} else {
+		return thumbnail.Options{}, errBadRequest
+	}
+
+	// A DPR in the URL takes precedence over the client's hint.
+	if dpr == 0 && *clientHints {
+		dpr = hintedDPR(req.Header)
+	}
+	applyDPR(&o, dpr)
+
+	switch {
+	case *localImageDirectory != "":
+		req.URL.Scheme = "file"
+		req.URL.Host = "localhost"
+	case *s3Bucket != "":
+		req.URL.Scheme = "s3"
+		req.URL.Host = *s3Bucket
+	default:
+		if err := routeOrigin(req, originRoutes, originHosts, *originScheme); err != nil {
+			return thumbnail.Options{}, err
+		}
+	}
+
+	return o, nil
+}
+
+// pathOptions applies the scaling parameters matched by matchPath to o,
+// and returns the DPR they ask for, if any.
+func pathOptions(g []string, o *thumbnail.Options) (float64, error) {
+	preview := g[2] == "p"
+	webp := g[3] == "w"
+	cropMode, crop := pathCropModes[g[4]]
+	pad := g[4] == "l"
+	width, _ := strconv.Atoi(g[5])
+	height, _ := strconv.Atoi(g[6])
+
+	// Disallow repeated scaling parameters.
+	if matchPath.MatchString(g[1]) {
+		return 0, errBadRequest
+	}
+
+	// Either width or height may be left out, leaving it to follow from
+	// the aspect ratio, but not both, and not for an exact size.
+	if g[5] == "" && g[6] == "" {
+		return 0, errBadRequest
+	}
+	if (g[5] == "" || g[6] == "") && (crop || pad) {
+		return 0, errMissingDimension
+	}
+
+	if (g[5] != "" && width == 0) || (g[6] != "" && height == 0) || width > *maxOutputDimension || height > *maxOutputDimension {
+		return 0, errBadRequest
+	}
+
+	o.Width = width
+	o.Height = height
+	o.Crop = crop
+	o.CropMode = cropMode
+	o.Pad = pad
+
+	// After ",", a DPR such as "2x" multiplies the width and height.
+	var dpr float64
+	if g[7] != "" {
+		var err error
+		if dpr, err = parseFloat(g[7], 1, maxDPR); err != nil {
+			return 0, errBadRequest
+		}
+	}
+
+	// After "@", a crop takes a focal point, which overrides the crop
+	// operation's CropMode, and padding takes a background color.
+	if g[8] != "" {
+		switch {
+		case crop:
+			focus, err := parseFocus(g[8])
+			if err != nil {
+				return 0, errBadRequest
+			}
+			o.CropMode = thumbnail.CropFocus
+			o.Focus = focus
+		case pad:
+			color, err := parseColor(g[8])
+			if err != nil {
+				return 0, errBadRequest
+			}
+			o.Background = color
+		default:
+			return 0, errBadRequest
+		}
+	}
 
 	if webp {
 		o.Save.AllowWebp = true
@@ -104,5 +298,5 @@ func director(req *http.Request) (thumbnail.Options, int) {
 		o.Save.Quality = 40
 	}
 
-	return o, 0
+	return dpr, nil
 }
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"testing"
@@ -15,6 +16,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/die-net/fotomat/v2/format"
+	"github.com/die-net/fotomat/v2/thumbnail"
 	"github.com/die-net/fotomat/v2/vips"
 )
 
@@ -63,6 +65,28 @@ func TestSuccess(t *testing.T) {
 
 	// Crop 3000x2000 PNG to a small preview JPEG.
 	assert.Nil(t, isSize("3000px.png=pc16x16", format.Jpeg, 16, 16))
+
+	// Crop centred, by entropy, and by attention.
+	assert.Nil(t, isSize("watermelon.jpg=m200x100", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=e200x100", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=wa200x100", format.Webp, 200, 100))
+
+	// Crop around a focal point or gravity.
+	assert.Nil(t, isSize("watermelon.jpg=c200x100@0.5,0.8", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg=m200x100@southeast", format.Jpeg, 200, 100))
+
+	// Pad with white, or a background color, keeping an opaque JPEG a JPEG.
+	assert.Nil(t, isSize("watermelon.jpg=l200x200", format.Jpeg, 200, 200))
+	assert.Nil(t, isSize("watermelon.jpg=l200x200@ffffff", format.Jpeg, 200, 200))
+
+	// Constrain only the width or the height.
+	assert.Nil(t, isSize("watermelon.jpg=s199x", format.Jpeg, 199, 268))
+	assert.Nil(t, isSize("watermelon.jpg=sx268", format.Jpeg, 199, 268))
+	assert.Nil(t, isSize("watermelon.jpg=sx50,2x", format.Jpeg, 75, 100))
+
+	// Multiply the size by a DPR.
+	assert.Nil(t, isSize("watermelon.jpg=s50x50,2x", format.Jpeg, 75, 100))
+	assert.Nil(t, isSize("watermelon.jpg=c100x50,1.5x@north", format.Jpeg, 150, 75))
 }
 
 func TestResponseErrors(t *testing.T) {
@@ -104,10 +128,197 @@ func TestParameterValidation(t *testing.T) {
 	assert.Equal(t, status("watermelon.jpg=c2049x16"), http.StatusBadRequest)
 	assert.Equal(t, status("watermelon.jpg=c16x2049"), http.StatusBadRequest)
 
+	// Refuse a missing width and height, or either when cropping or padding.
+	assert.Equal(t, status("watermelon.jpg=sx"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s0x"), http.StatusBadRequest)
+	body, code := fetch("watermelon.jpg=c200x")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "crop and pad need both a width and a height\n", string(body))
+	assert.Equal(t, status("watermelon.jpg=lx200"), http.StatusBadRequest)
+
+	// Refuse a focal point without a crop, or outside the image.
+	assert.Equal(t, status("watermelon.jpg=s16x16@north"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16@up"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=c16x16@1.5,0"), http.StatusBadRequest)
+
+	// Refuse a background color without padding, or a bad one.
+	assert.Equal(t, status("watermelon.jpg=s16x16@ffffff"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=l16x16@north"), http.StatusBadRequest)
+
+	// Refuse a DPR below 1 or above 4.
+	assert.Equal(t, status("watermelon.jpg=s16x16,0.5x"), http.StatusBadRequest)
+	assert.Equal(t, status("watermelon.jpg=s16x16,5x"), http.StatusBadRequest)
+
 	// Refuse repeated scale parameters.
 	assert.Equal(t, status("watermelon.jpg=s16x16=s16x16"), http.StatusBadRequest)
 }
 
+func TestQuerySuccess(t *testing.T) {
+	// Scale JPEG.
+	assert.Nil(t, isSize("watermelon.jpg?w=100&h=100", format.Jpeg, 75, 100))
+
+	// Crop JPEG to 200x100 and convert to WebP.
+	assert.Nil(t, isSize("watermelon.jpg?w=200&h=100&fit=crop&fmt=webp", format.Webp, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg?w=200&h=100&fit=crop&crop=attention", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg?w=200&h=100&fit=crop&focus=North", format.Jpeg, 200, 100))
+	assert.Nil(t, isSize("watermelon.jpg?w=200&h=200&fit=pad&bg=000000", format.Jpeg, 200, 200))
+
+	// Only enlarge when asked to, and -enlarge allows it.
+	assert.Nil(t, isSize("watermelon.jpg?w=796&h=1072", format.Jpeg, 398, 536))
+	*enlarge = true
+	assert.Nil(t, isSize("watermelon.jpg?w=796&h=1072&enlarge=true", format.Jpeg, 796, 1072))
+	assert.Nil(t, isSize("watermelon.jpg?w=796&h=1072&enlarge=false", format.Jpeg, 398, 536))
+	*enlarge = false
+
+	// Multiply the size by a DPR, keeping within -max_output_dimension.
+	assert.Nil(t, isSize("watermelon.jpg?w=50&h=50&dpr=2", format.Jpeg, 75, 100))
+	assert.Nil(t, isSize("3000px.png?w=1500&h=1000&dpr=2&fmt=jpg", format.Jpeg, 2048, 1365))
+
+	// Without a width or height, keep the original size.
+	assert.Nil(t, isSize("2px.png?fmt=jpg&q=50", format.Jpeg, 2, 3))
+	assert.Nil(t, isSize("2px.png?fmt=PNG&compression=9&blur=0.5&sharpen=true", format.Png, 2, 3))
+	assert.Nil(t, isSize("2px.png?webp=1&lossless=false", format.Webp, 2, 3))
+}
+
+func TestQueryValidation(t *testing.T) {
+	for _, test := range []struct {
+		query   string
+		message string
+	}{
+		{"w=0", `bad "w" parameter: must be from 1 to 2048`},
+		{"h=2049", `bad "h" parameter: must be from 1 to 2048`},
+		{"w=ten", `bad "w" parameter: not an integer`},
+		{"w=10&w=20", `bad "w" parameter: specified more than once`},
+		{"fit=stretch", `bad "fit" parameter: must be scale, crop, or pad`},
+		{"w=100&fit=crop", `bad "h" parameter: required by fit=crop`},
+		{"h=100&fit=pad", `bad "w" parameter: required by fit=pad`},
+		{"fit=crop", `bad "w" parameter: required by fit=crop`},
+		{"bg=red", `bad "bg" parameter: must be hex RRGGBB or RRGGBBAA`},
+		{"bg=gggggg", `bad "bg" parameter: must be hex RRGGBB or RRGGBBAA`},
+		{"crop=left", `bad "crop" parameter: must be top, centre, entropy, or attention`},
+		{"w=100&h=100&crop=top", `bad "crop" parameter: needs fit=crop`},
+		{"w=100&h=100&fit=pad&crop=top", `bad "crop" parameter: needs fit=crop`},
+		{"w=100&h=100&focus=north", `bad "focus" parameter: needs fit=crop`},
+		{"w=100&h=100&fit=scale&focus=0.5,0.5", `bad "focus" parameter: needs fit=crop`},
+		{"w=100&h=100&bg=000000", `bad "bg" parameter: needs fit=pad`},
+		{"w=100&h=100&fit=crop&bg=000000", `bad "bg" parameter: needs fit=pad`},
+		{"focus=0.5", `bad "focus" parameter: must be x,y from 0 to 1, or a gravity such as north`},
+		{"focus=0.5,2", `bad "focus" parameter: must be x,y from 0 to 1, or a gravity such as north`},
+		{"focus=north&crop=top", `bad "focus" parameter: can't be used with crop`},
+		{"q=101", `bad "q" parameter: must be from 1 to 100`},
+		{"compression=0", `bad "compression" parameter: must be from 1 to 9`},
+		{"fmt=bmp", `bad "fmt" parameter: unsupported format`},
+		{"blur=9", `bad "blur" parameter: must be from 0 to 8`},
+		{"blur=NaN", `bad "blur" parameter: must be from 0 to 8`},
+		{"sharpen=maybe", `bad "sharpen" parameter: not true or false`},
+		{"dpr=0.5", `bad "dpr" parameter: must be from 1 to 4`},
+		{"dpr=2x", `bad "dpr" parameter: not a number`},
+		{"enlarge=maybe", `bad "enlarge" parameter: not true or false`},
+		{"enlarge=true", `bad "enlarge" parameter: not allowed`},
+		{"webp=true&lossless=true", `bad "lossless" parameter: not allowed`},
+		{"w=10&size=20", `bad "size" parameter: unknown parameter`},
+	} {
+		body, code := fetch("watermelon.jpg?" + test.query)
+		assert.Equal(t, http.StatusBadRequest, code, test.query)
+		assert.Equal(t, test.message+"\n", string(body), test.query)
+	}
+}
+
+func TestClientHints(t *testing.T) {
+	*clientHints = true
+	defer func() { *clientHints = false }()
+
+	for _, test := range []struct {
+		path   string
+		header http.Header
+		width  int
+		height int
+	}{
+		{"watermelon.jpg=s50x50", nil, 38, 50},
+		{"watermelon.jpg=s50x50", http.Header{"Dpr": {"2"}}, 75, 100},
+		{"watermelon.jpg=s50x50", http.Header{"Sec-Ch-Dpr": {"2"}, "Dpr": {"3"}}, 75, 100},
+		{"watermelon.jpg=s50x50", http.Header{"Sec-Ch-Dpr": {"bogus"}}, 38, 50},
+		{"watermelon.jpg=s50x50", http.Header{"Sec-Ch-Dpr": {"0.5"}}, 38, 50},
+		{"watermelon.jpg=s50x50,1x", http.Header{"Sec-Ch-Dpr": {"2"}}, 38, 50},
+		{"watermelon.jpg?w=50&h=50", http.Header{"Sec-Ch-Dpr": {"2"}}, 75, 100},
+	} {
+		m, err := fetchMetadata(test.path, test.header)
+		if assert.Nil(t, err, test.path) {
+			assert.Equal(t, test.width, m.Width, "%s %v", test.path, test.header)
+			assert.Equal(t, test.height, m.Height, "%s %v", test.path, test.header)
+		}
+	}
+}
+
+func TestHintedDPR(t *testing.T) {
+	for _, test := range []struct {
+		hint string
+		dpr  float64
+	}{
+		{"", 0},
+		{"bogus", 0},
+		{"0.5", 1},
+		{"1.2345", 1},
+		{"1.3", 1.5},
+		{"1.75", 2},
+		{"2.6", 2.5},
+		{"9", 4},
+	} {
+		assert.Equal(t, test.dpr, hintedDPR(http.Header{"Dpr": {test.hint}}), test.hint)
+	}
+
+	// Hints that differ only slightly give the same Options.
+	options := func(hint string) thumbnail.Options {
+		o := thumbnail.Options{Width: 100, Height: 100}
+		applyDPR(&o, hintedDPR(http.Header{"Dpr": {hint}}))
+		return o
+	}
+	assert.Equal(t, options("1.2345"), options("1.2346"))
+	assert.Equal(t, options("2.2345"), options("2.2346"))
+}
+
+func TestSignature(t *testing.T) {
+	urlSigningKeys = [][]byte{[]byte("current"), []byte("previous")}
+	defer func() { urlSigningKeys = nil }()
+
+	// Refuse missing and malformed signatures.
+	assert.Equal(t, status("watermelon.jpg=s16x16"), http.StatusForbidden)
+	assert.Equal(t, status("watermelon.jpg=s16x16?sig="), http.StatusForbidden)
+	assert.Equal(t, status("watermelon.jpg=s16x16?sig=!!!"), http.StatusForbidden)
+
+	// Refuse a signature for different scaling parameters.
+	sig := sign([]byte("current"), localhost+"/watermelon.jpg=s16x16")
+	assert.Equal(t, status("watermelon.jpg=s32x32?sig="+sig), http.StatusForbidden)
+
+	// Refuse a signature made with an unknown key.
+	sig = sign([]byte("unknown"), localhost+"/watermelon.jpg=s16x16")
+	assert.Equal(t, status("watermelon.jpg=s16x16?sig="+sig), http.StatusForbidden)
+
+	// Refuse a signature made for another host.
+	sig = sign([]byte("current"), "img.example.com/watermelon.jpg=s16x16")
+	assert.Equal(t, status("watermelon.jpg=s16x16?sig="+sig), http.StatusForbidden)
+
+	// Accept signatures made with any configured key.
+	for _, key := range urlSigningKeys {
+		sig = sign(key, localhost+"/watermelon.jpg=s16x16")
+		assert.Nil(t, isSize("watermelon.jpg=s16x16?sig="+sig, format.Jpeg, 12, 16))
+	}
+}
+
+func TestSignatureHost(t *testing.T) {
+	keys := [][]byte{[]byte("current")}
+	u, err := url.Parse("/watermelon.jpg?w=16&h=16&sig=" + sign(keys[0], "a.example.com/watermelon.jpg?h=16&w=16"))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// A signature is only valid for the host it was made for, in any case.
+	assert.True(t, validSignature("a.example.com", u, keys))
+	assert.True(t, validSignature("A.Example.COM", u, keys))
+	assert.False(t, validSignature("b.example.com", u, keys))
+	assert.False(t, validSignature("", u, keys))
+}
+
 func isSize(filename string, f format.Format, width, height int) error {
 	image, code := fetch(filename)
 	if code != 200 {
@@ -132,6 +343,33 @@ func status(filename string) int {
 	return code
 }
 
+func fetchMetadata(filename string, header http.Header) (format.Metadata, error) {
+	req, err := http.NewRequest("GET", "http://"+localhost+"/"+filename, http.NoBody)
+	if err != nil {
+		return format.Metadata{}, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return format.Metadata{}, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return format.Metadata{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return format.Metadata{}, fmt.Errorf("got HTTP error %d", resp.StatusCode)
+	}
+
+	return format.MetadataBytes(body)
+}
+
 func fetch(filename string) ([]byte, int) {
 	resp, err := http.Get("http://" + localhost + "/" + filename)
 	if err != nil {
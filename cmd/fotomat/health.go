@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+var readinessTimeout = flag.Duration("readiness_timeout", 5*time.Second, "How long /readyz waits for a test image to be processed before reporting not ready.")
+
+// draining is set to 1 once the server has started shutting down.
+var draining int32
+
+// healthHandler reports that the server is running.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyHandler reports whether this server should be sent image requests:
+// not while it is shutting down, or if proxy can't process a test image
+// in time, as when its workers are stuck.  How many of proxy's places for
+// original images are in use is reported either way.
+func readyHandler(proxy *thumbnail.Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		active, maxActive := proxy.Active()
+		status, message := http.StatusOK, "ok"
+
+		if atomic.LoadInt32(&draining) != 0 {
+			status, message = http.StatusServiceUnavailable, "shutting down"
+		} else {
+			ctx, cancel := context.WithTimeout(r.Context(), *readinessTimeout)
+			defer cancel()
+			if err := proxy.Check(ctx); err != nil {
+				status, message = http.StatusServiceUnavailable, "image processing failed: "+err.Error()
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%s\nactive %d/%d\n", message, active, maxActive)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+func TestHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReady(t *testing.T) {
+	proxy := thumbnail.NewProxyErr(director, thumbnail.NewPool(1, 1), 2, http.DefaultClient)
+	defer proxy.Close()
+
+	status, body := ready(proxy)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok\nactive 0/2\n", body)
+
+	atomic.StoreInt32(&draining, 1)
+	defer atomic.StoreInt32(&draining, 0)
+	status, body = ready(proxy)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.True(t, strings.HasPrefix(body, "shutting down\n"))
+}
+
+func ready(proxy *thumbnail.Proxy) (int, string) {
+	w := httptest.NewRecorder()
+	readyHandler(proxy)(w, httptest.NewRequest("GET", "/readyz", nil))
+	return w.Code, w.Body.String()
+}
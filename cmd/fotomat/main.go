@@ -1,22 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof" //nolint:gosec // TODO: Move this to its own port.
 	"os"
+	"os/signal"
 	"runtime"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/die-net/fotomat/v2/vips"
 )
 
 var (
-	debugListen = flag.String("debug_listen", "127.0.0.1:3521", "[IP]:port to listen for pprof and metrics requests. (\"\" = disable)")
-	listen      = flag.String("listen", "127.0.0.1:3520", "[IP]:port to listen for image serving requests.")
-	version     = flag.Bool("version", false, "Show version and exit.")
+	debugListen         = flag.String("debug_listen", "127.0.0.1:3521", "[IP]:port to listen for pprof and metrics requests. (\"\" = disable)")
+	listen              = flag.String("listen", "127.0.0.1:3520", "[IP]:port to listen for image serving requests.")
+	shutdownGracePeriod = flag.Duration("shutdown_grace_period", 20*time.Second, "How long to wait for requests in progress to finish after SIGTERM or SIGINT before exiting anyway.")
+	version             = flag.Bool("version", false, "Show version and exit.")
 )
 
 func main() {
@@ -33,11 +40,18 @@ func main() {
 		os.Exit(0)
 	}
 
+	proxy := handleInit()
+
 	if *debugListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", healthHandler)
+		mux.Handle("/readyz", readyHandler(proxy))
+		mux.Handle("/", promhttp.Handler())
+
 		go func() {
 			ps := &http.Server{
 				Addr:         *debugListen,
-				Handler:      promhttp.Handler(),
+				Handler:      mux,
 				ReadTimeout:  10 * time.Second,
 				WriteTimeout: 10 * time.Second,
 				IdleTimeout:  5 * time.Minute,
@@ -46,13 +60,44 @@ func main() {
 		}()
 	}
 
-	handler := handleInit()
 	srv := &http.Server{
 		Addr:         *listen,
-		Handler:      prometheusWrapHandler(handler),
+		Handler:      prometheusWrapHandler(proxy),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  5 * time.Minute,
 	}
-	log.Fatal(srv.ListenAndServe())
+
+	drained := make(chan struct{})
+	go drainOnSignal(srv, drained)
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
+
+	// Nothing is using the image pipeline now, so it can be stopped.
+	proxy.Close()
+	vips.Shutdown()
+}
+
+// drainOnSignal waits for SIGTERM or SIGINT, then stops srv accepting
+// connections and waits for its requests in progress to finish, up to
+// -shutdown_grace_period, before closing drained.
+func drainOnSignal(srv *http.Server, drained chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+
+	log.Printf("Received %v, finishing requests in progress", sig)
+	atomic.StoreInt32(&draining, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGracePeriod)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Requests still in progress after -shutdown_grace_period: %v", err)
+	}
+
+	close(drained)
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+var (
+	originMap           = flag.String("origin_map", "", "Comma-separated list of host, /path/prefix, or host/path/prefix=base URL mappings to fetch original images from, each optionally followed by ;ca_file=, ;cert_file=, ;key_file=, or ;server_name= settings for an HTTPS base URL (\"\"=fetch from the Host header's server).")
+	originAllowHosts    = flag.String("origin_allow_hosts", "", "Comma-separated list of hosts, or *.domain wildcards, that may be fetched from as given by the Host header, if not in -origin_map (\"\"=any if -origin_map is empty).")
+	originScheme        = flag.String("origin_scheme", "http", "Scheme, http or https, to fetch original images with from the Host header's server.")
+	allowOriginNetworks = flag.String("allow_origin_networks", "", "Comma-separated list of CIDR networks that original images may be fetched from, even though they are private, loopback, or link-local.")
+)
+
+var (
+	// originRoutes and originHosts are the parsed forms of originMap and
+	// originAllowHosts, set by handleInit.
+	originRoutes []originRoute
+	originHosts  []string
+
+	errOriginForbidden = &thumbnail.StatusError{Status: http.StatusForbidden, Message: "origin not allowed"}
+	errBlockedAddress  = errors.New("origin address not allowed")
+
+	// blockedNetworks are the shared, documentation, benchmarking, and
+	// reserved networks that originDialControl refuses, besides those
+	// net.IP can recognize itself.
+	blockedNetworks = mustParseNetworks("0.0.0.0/8,100.64.0.0/10,192.0.0.0/24,192.0.2.0/24,198.18.0.0/15,198.51.100.0/24,203.0.113.0/24,240.0.0.0/4," +
+		"64:ff9b:1::/48,100::/64,2001::/23,2001:db8::/32,2002::/16,fec0::/10")
+)
+
+// newOrigin returns the Origin to fetch original images from: the
+// -s3_bucket if one is given, or else the server each request is routed
+// to, dialed only at public addresses or those in allowed.  The S3
+// endpoint is chosen by the operator rather than by requests, so it may
+// be on any network.  HTTPS connections use each route's own TLS
+// settings, if it has any, over defaults.
+func newOrigin(allowed []*net.IPNet, routes []originRoute, defaults originTLS) (thumbnail.Origin, error) {
+	config, err := defaults.config()
+	if err != nil {
+		return nil, err
+	}
+
+	if *s3Bucket != "" {
+		return newS3Origin(&http.Client{Transport: newOriginTransport(nil, config), Timeout: *fetchTimeout}), nil
+	}
+
+	control := originDialControl(allowed)
+	transport := &hostTransport{
+		hosts:    make(map[string]http.RoundTripper),
+		fallback: newOriginTransport(control, config),
+	}
+	if *localImageDirectory != "" {
+		transport.fallback.RegisterProtocol("file", http.NewFileTransport(http.Dir(*localImageDirectory)))
+	}
+
+	// Only requests for a route's own host use its settings, so that
+	// neither they, nor redirects to elsewhere, get another's.
+	settings := make(map[string]originTLS)
+	for _, r := range routes {
+		if r.tls.isZero() {
+			continue
+		}
+		host := strings.ToLower(r.base.Host)
+		if s, ok := settings[host]; ok {
+			if s != r.tls {
+				return nil, fmt.Errorf("%s has different TLS settings in different routes", host)
+			}
+			continue
+		}
+		settings[host] = r.tls
+
+		config, err := r.tls.over(defaults).config()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", host, err)
+		}
+		transport.hosts[host] = newOriginTransport(control, config)
+	}
+
+	return &http.Client{Transport: transport, Timeout: *fetchTimeout}, nil
+}
+
+// newOriginTransport returns a Transport for fetching original images,
+// which checks each address it dials with control, if it isn't nil.
+func newOriginTransport(control func(network, address string, c syscall.RawConn) error, tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: control}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: dialer.DialContext, TLSClientConfig: tlsConfig}
+}
+
+// hostTransport sends each request with the RoundTripper for its URL's
+// host, or else with fallback.
+type hostTransport struct {
+	hosts    map[string]http.RoundTripper
+	fallback *http.Transport
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.hosts[strings.ToLower(req.URL.Host)]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// originRoute maps requests for host (any if empty) under path prefix
+// to base, connecting to it with tls if it is HTTPS.
+type originRoute struct {
+	host   string
+	prefix string
+	base   *url.URL
+	tls    originTLS
+}
+
+// parseOriginMap parses -origin_map into routes, longest prefix first.
+func parseOriginMap(s string) ([]originRoute, error) {
+	var routes []originRoute
+	for _, mapping := range strings.Split(s, ",") {
+		if mapping == "" {
+			continue
+		}
+
+		settings := strings.Split(mapping, ";")
+		i := strings.IndexByte(settings[0], '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%q isn't from=base", mapping)
+		}
+		from, to := settings[0][:i], settings[0][i+1:]
+
+		base, err := url.Parse(to)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" || base.RawQuery != "" {
+			return nil, fmt.Errorf("%q isn't an http or https base URL", to)
+		}
+
+		r := originRoute{base: base}
+		for _, setting := range settings[1:] {
+			i := strings.IndexByte(setting, '=')
+			if i < 0 {
+				return nil, fmt.Errorf("%q isn't setting=value", setting)
+			}
+			if err := r.tls.set(setting[:i], setting[i+1:]); err != nil {
+				return nil, fmt.Errorf("%q: %v", mapping, err)
+			}
+		}
+		if !r.tls.isZero() && base.Scheme != "https" {
+			return nil, fmt.Errorf("%q has TLS settings for an http base URL", mapping)
+		}
+		if (r.tls.certFile == "") != (r.tls.keyFile == "") {
+			return nil, fmt.Errorf("%q needs both a cert_file and a key_file", mapping)
+		}
+		if i := strings.IndexByte(from, '/'); i >= 0 {
+			r.host, r.prefix = from[:i], strings.TrimSuffix(from[i:], "/")
+		} else {
+			r.host = from
+		}
+		if from == "" {
+			return nil, fmt.Errorf("%q needs a host or path prefix", mapping)
+		}
+		r.host = strings.ToLower(r.host)
+
+		routes = append(routes, r)
+	}
+
+	// Prefer the most specific route.
+	sort.SliceStable(routes, func(i, j int) bool {
+		if len(routes[i].prefix) != len(routes[j].prefix) {
+			return len(routes[i].prefix) > len(routes[j].prefix)
+		}
+		return routes[i].host != "" && routes[j].host == ""
+	})
+
+	return routes, nil
+}
+
+// parseHostList parses a comma-separated list of host names.
+func parseHostList(s string) []string {
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		if host != "" {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+	}
+	return hosts
+}
+
+// routeOrigin points req's URL at the server to fetch the original image
+// from: the first of routes that matches, or else the server named by the
+// Host header, over scheme, if hosts allows it.
+func routeOrigin(req *http.Request, routes []originRoute, hosts []string, scheme string) error {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, r := range routes {
+		if r.matches(host, req.URL.Path) {
+			r.apply(req.URL)
+			return nil
+		}
+	}
+
+	if (len(routes) > 0 || len(hosts) > 0) && !hostAllowed(host, hosts) {
+		return errOriginForbidden
+	}
+
+	req.URL.Scheme = scheme
+	req.URL.Host = req.Host
+	return nil
+}
+
+func (r originRoute) matches(host, path string) bool {
+	if r.host != "" && r.host != host {
+		return false
+	}
+	return path == r.prefix || strings.HasPrefix(path, r.prefix+"/")
+}
+
+// apply replaces the route's prefix in u with its base URL.
+func (r originRoute) apply(u *url.URL) {
+	path := strings.TrimPrefix(u.Path, r.prefix)
+	u.Scheme = r.base.Scheme
+	u.Host = r.base.Host
+	u.Path = strings.TrimSuffix(r.base.Path, "/") + path
+	u.RawPath = ""
+}
+
+// hostAllowed returns true if host is listed in hosts, or matches a
+// "*.domain" wildcard there.
+func hostAllowed(host string, hosts []string) bool {
+	for _, allowed := range hosts {
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a comma-separated list of CIDR networks.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// mustParseNetworks is parseNetworks for networks known to be valid.
+func mustParseNetworks(s string) []*net.IPNet {
+	networks, err := parseNetworks(s)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// originDialControl returns a net.Dialer Control function that refuses to
+// connect to private, loopback, link-local, shared, reserved, and other
+// non-public addresses not in allowed.  Checking the address actually
+// dialed, after name resolution and for every redirect, means a hostile
+// origin can't steer requests to internal services.
+func originDialControl(allowed []*net.IPNet) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return errBlockedAddress
+		}
+
+		for _, n := range allowed {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+			ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+			return errBlockedAddress
+		}
+		for _, n := range blockedNetworks {
+			if n.Contains(ip) {
+				return errBlockedAddress
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteOrigin(t *testing.T) {
+	routes, err := parseOriginMap("img.example.com=https://origin.example.net/images/,/avatars=http://avatars.internal:8080,img.example.com/static/=https://static.example.net,/=https://default.example.org/base")
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		host string
+		path string
+		url  string
+	}{
+		{"img.example.com", "/a/b.jpg", "https://origin.example.net/images/a/b.jpg"},
+		{"IMG.example.com:8080", "/a.jpg", "https://origin.example.net/images/a.jpg"},
+		{"img.example.com", "/static/a.jpg", "https://static.example.net/a.jpg"},
+		{"img.example.com", "/avatars/a.jpg", "http://avatars.internal:8080/a.jpg"},
+		{"other.example.com", "/avatars/a.jpg", "http://avatars.internal:8080/a.jpg"},
+		{"other.example.com", "/avatarsa.jpg", "https://default.example.org/base/avatarsa.jpg"},
+		{"other.example.com", "/a%20b.jpg", "https://default.example.org/base/a%20b.jpg"},
+	} {
+		req, err := http.NewRequest("GET", "http://"+test.host+test.path, http.NoBody)
+		assert.Nil(t, err)
+		assert.Nil(t, routeOrigin(req, routes, nil, "http"), test.host+test.path)
+		assert.Equal(t, test.url, req.URL.String(), test.host+test.path)
+	}
+
+	// Without a matching route, only allowed hosts are fetched from, over
+	// http.
+	routes, err = parseOriginMap("/avatars=https://avatars.example.net")
+	assert.Nil(t, err)
+	hosts := parseHostList("img.example.com,*.example.org")
+	for _, test := range []struct {
+		host string
+		err  error
+	}{
+		{"img.example.com", nil},
+		{"cdn.example.org", nil},
+		{"example.org", errOriginForbidden},
+		{"169.254.169.254", errOriginForbidden},
+	} {
+		req, err := http.NewRequest("GET", "http://"+test.host+"/a.jpg", http.NoBody)
+		assert.Nil(t, err)
+		assert.Equal(t, test.err, routeOrigin(req, routes, hosts, "http"), test.host)
+		if test.err == nil {
+			assert.Equal(t, "http://"+test.host+"/a.jpg", req.URL.String())
+		}
+	}
+
+	// With neither, any host is, with the given scheme.
+	req, err := http.NewRequest("GET", "http://anywhere.example.com/a.jpg", http.NoBody)
+	assert.Nil(t, err)
+	assert.Nil(t, routeOrigin(req, nil, nil, "https"))
+	assert.Equal(t, "https://anywhere.example.com/a.jpg", req.URL.String())
+}
+
+func TestParseOriginMapErrors(t *testing.T) {
+	for _, s := range []string{
+		"img.example.com",
+		"img.example.com=ftp://origin.example.net",
+		"img.example.com=origin.example.net",
+		"img.example.com=https://origin.example.net/?a=b",
+		"=https://origin.example.net",
+		"img.example.com=https://origin.example.net;server_name",
+		"img.example.com=https://origin.example.net;sni=origin.test",
+		"img.example.com=http://origin.example.net;server_name=origin.test",
+		"img.example.com=https://origin.example.net;cert_file=client.crt",
+	} {
+		_, err := parseOriginMap(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestOriginDialControl(t *testing.T) {
+	networks, err := parseNetworks("10.1.0.0/16,fd00::/8")
+	assert.Nil(t, err)
+	control := originDialControl(networks)
+
+	for _, test := range []struct {
+		address string
+		err     error
+	}{
+		{"93.184.216.34:80", nil},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", nil},
+		{"10.1.2.3:80", nil},
+		{"[fd00::1]:80", nil},
+		{"10.2.0.1:80", errBlockedAddress},
+		{"192.168.1.1:80", errBlockedAddress},
+		{"127.0.0.1:80", errBlockedAddress},
+		{"[::1]:80", errBlockedAddress},
+		{"169.254.169.254:80", errBlockedAddress},
+		{"[fe80::1]:80", errBlockedAddress},
+		{"0.0.0.0:80", errBlockedAddress},
+		{"[::ffff:127.0.0.1]:80", errBlockedAddress},
+		{"100.64.0.1:80", errBlockedAddress},
+		{"100.127.255.254:80", errBlockedAddress},
+		{"100.128.0.1:80", nil},
+		{"192.0.2.1:80", errBlockedAddress},
+		{"198.18.0.1:80", errBlockedAddress},
+		{"240.0.0.1:80", errBlockedAddress},
+		{"255.255.255.255:80", errBlockedAddress},
+		{"[2001:db8::1]:80", errBlockedAddress},
+		{"[2002:a00:1::1]:80", errBlockedAddress},
+	} {
+		assert.Equal(t, test.err, control("tcp", test.address, nil), test.address)
+	}
+
+	// Really refuse connections.
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listen.Close()
+	_, err = (&net.Dialer{Control: control}).Dial("tcp", listen.Addr().String())
+	assert.ErrorIs(t, err, errBlockedAddress)
+
+	_, err = parseNetworks("10.0.0.0")
+	assert.NotNil(t, err)
+}
+
+func TestNewOriginS3(t *testing.T) {
+	// An S3-compatible store on a loopback address, as for MinIO.
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/cat.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "meow")
+	}))
+	defer store.Close()
+
+	defer func(bucket, endpoint string, pathStyle bool, dir string) {
+		*s3Bucket, *s3Endpoint, *s3PathStyle, *localImageDirectory = bucket, endpoint, pathStyle, dir
+	}(*s3Bucket, *s3Endpoint, *s3PathStyle, *localImageDirectory)
+	*localImageDirectory = ""
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+
+	// Proxied servers at that address are refused.
+	req, err := http.NewRequest("GET", store.URL+"/images/cat.jpg", http.NoBody)
+	assert.Nil(t, err)
+	origin, err := newOrigin(nil, nil, originTLS{})
+	assert.Nil(t, err)
+	_, err = origin.Do(req)
+	assert.ErrorIs(t, err, errBlockedAddress)
+
+	// But the configured S3 endpoint isn't.
+	*s3Bucket, *s3Endpoint, *s3PathStyle = "images", store.URL, true
+	req, err = http.NewRequest("GET", "/cat.jpg", http.NoBody)
+	assert.Nil(t, err)
+	origin, err = newOrigin(nil, nil, originTLS{})
+	assert.Nil(t, err)
+	resp, err := origin.Do(req)
+	if assert.Nil(t, err) {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "meow", string(body))
+	}
+}
@@ -5,6 +5,8 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/die-net/fotomat/v2/thumbnail"
 )
 
 var (
@@ -44,6 +46,125 @@ var (
 
 func prometheusInit() {
 	prometheus.MustRegister(inFlightGauge, counter, duration, responseSize)
+
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "thumbnail_aborted_total",
+				Help: "A counter of image operations aborted for taking longer than -max_processing_duration.",
+			},
+			func() float64 { return float64(thumbnail.Aborts().Aborted) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "thumbnail_escalated_total",
+				Help: "A counter of aborted image operations still running -abort_grace_period later.",
+			},
+			func() float64 { return float64(thumbnail.Aborts().Escalated) },
+		),
+	)
+}
+
+// prometheusRegisterOriginalCache exports the activity of a cache of
+// original images.
+func prometheusRegisterOriginalCache(c *thumbnail.OriginalCache) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "original_cache_hits_total",
+				Help: "A counter of original images found in the cache.",
+			},
+			func() float64 { return float64(c.Stats().Hits) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "original_cache_misses_total",
+				Help: "A counter of original images not found in the cache.",
+			},
+			func() float64 { return float64(c.Stats().Misses) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "original_cache_evictions_total",
+				Help: "A counter of original images removed from the cache to make room.",
+			},
+			func() float64 { return float64(c.Stats().Evictions) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "original_cache_bytes",
+				Help: "A gauge of the size of original images in the cache.",
+			},
+			func() float64 { return float64(c.Stats().Bytes) },
+		),
+	)
+}
+
+// prometheusRegisterPool exports how many requests of each Priority are
+// waiting for a Pool's workers.
+func prometheusRegisterPool(pool *thumbnail.Pool) {
+	for _, priority := range thumbnail.Priorities {
+		priority := priority
+		prometheus.MustRegister(
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Name:        "thumbnail_queue_depth",
+					Help:        "A gauge of image operations waiting for a thread, by priority.",
+					ConstLabels: prometheus.Labels{"priority": priority.String()},
+				},
+				func() float64 { return float64(pool.QueueDepth(priority)) },
+			),
+		)
+	}
+}
+
+// prometheusRegisterUpstreams exports how a Proxy has treated its
+// origins.
+func prometheusRegisterUpstreams(p *thumbnail.Proxy) {
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "fetch_retries_total",
+				Help: "A counter of original image fetches retried after a failure.",
+			},
+			func() float64 { return float64(p.UpstreamStats().Retries) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "fetches_in_flight",
+				Help: "A gauge of original images currently being fetched.",
+			},
+			func() float64 { return float64(p.UpstreamStats().Fetching) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "origin_fetch_waits_total",
+				Help: "A counter of requests that waited because their origin had -max_origin_fetches in progress.",
+			},
+			func() float64 { return float64(p.UpstreamStats().LimitWaits) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "origin_breaker_trips_total",
+				Help: "A counter of times an origin's circuit breaker opened.",
+			},
+			func() float64 { return float64(p.UpstreamStats().BreakerTrips) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "origin_breaker_rejections_total",
+				Help: "A counter of requests refused because their origin's circuit breaker was open.",
+			},
+			func() float64 { return float64(p.UpstreamStats().BreakerRejects) },
+		),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "origin_breakers_open",
+				Help: "A gauge of origins whose circuit breaker is open.",
+			},
+			func() float64 { return float64(p.UpstreamStats().OpenBreakers) },
+		),
+	)
 }
 
 func prometheusWrapHandler(handler http.Handler) http.Handler {
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/die-net/fotomat/v2/format"
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+var (
+	errNotInteger = errors.New("not an integer")
+	errNotNumber  = errors.New("not a number")
+	errNotBool    = errors.New("not true or false")
+	errRepeated   = errors.New("specified more than once")
+	errFocus      = errors.New("must be x,y from 0 to 1, or a gravity such as north")
+	errColor      = errors.New("must be hex RRGGBB or RRGGBBAA")
+	errNotAllowed = errors.New("not allowed")
+)
+
+// saveFormats maps the names accepted by the "fmt" query parameter to
+// output Formats.
+var saveFormats = map[string]format.Format{
+	"jpeg": format.Jpeg,
+	"jpg":  format.Jpeg,
+	"png":  format.Png,
+	"webp": format.Webp,
+	"gif":  format.Gif,
+	"avif": format.Avif,
+	"heif": format.Heif,
+	"heic": format.Heif,
+}
+
+// cropModes maps the names accepted by the "crop" query parameter to
+// CropModes.
+var cropModes = map[string]thumbnail.CropMode{
+	"top":       thumbnail.CropTop,
+	"centre":    thumbnail.CropCentre,
+	"center":    thumbnail.CropCentre,
+	"entropy":   thumbnail.CropEntropy,
+	"attention": thumbnail.CropAttention,
+}
+
+// gravities maps the names accepted as a focal point to FocalPoints.
+var gravities = map[string]thumbnail.FocalPoint{
+	"centre":    {X: 0.5, Y: 0.5},
+	"center":    {X: 0.5, Y: 0.5},
+	"north":     {X: 0.5, Y: 0},
+	"south":     {X: 0.5, Y: 1},
+	"east":      {X: 1, Y: 0.5},
+	"west":      {X: 0, Y: 0.5},
+	"northeast": {X: 1, Y: 0},
+	"northwest": {X: 0, Y: 0},
+	"southeast": {X: 1, Y: 1},
+	"southwest": {X: 0, Y: 1},
+}
+
+// queryOptions applies scaling parameters from a query string, such as
+// "?w=300&h=200&fit=crop&q=70", to o. The error for an unknown or invalid
+// parameter names that parameter.  It returns the DPR asked for, if any.
+func queryOptions(query url.Values, o *thumbnail.Options) (float64, error) {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	losslessGiven := false
+	var dpr float64
+	for _, key := range keys {
+		if len(query[key]) != 1 {
+			return 0, queryError(key, errRepeated)
+		}
+		value := query[key][0]
+
+		var err error
+		switch key {
+		case "w":
+			o.Width, err = parseInt(value, 1, *maxOutputDimension)
+		case "h":
+			o.Height, err = parseInt(value, 1, *maxOutputDimension)
+		case "dpr":
+			dpr, err = parseFloat(value, 1, maxDPR)
+		case "fit":
+			switch value {
+			case "scale":
+				o.Crop, o.Pad = false, false
+			case "crop":
+				o.Crop, o.Pad = true, false
+			case "pad":
+				o.Crop, o.Pad = false, true
+			default:
+				err = errors.New("must be scale, crop, or pad")
+			}
+		case "bg":
+			o.Background, err = parseColor(value)
+		case "crop":
+			mode, ok := cropModes[strings.ToLower(value)]
+			if !ok {
+				err = errors.New("must be top, centre, entropy, or attention")
+			}
+			o.CropMode = mode
+		case "focus":
+			if _, ok := query["crop"]; ok {
+				err = errors.New("can't be used with crop")
+				break
+			}
+			o.Focus, err = parseFocus(value)
+			o.CropMode = thumbnail.CropFocus
+		case "q":
+			o.Save.Quality, err = parseInt(value, 1, 100)
+		case "compression":
+			o.Save.Compression, err = parseInt(value, 1, 9)
+		case "fmt":
+			f, ok := saveFormats[strings.ToLower(value)]
+			if !ok {
+				err = errors.New("unsupported format")
+			}
+			o.Save.Format = f
+		case "blur":
+			o.BlurSigma, err = parseFloat(value, 0, 8)
+		case "enlarge":
+			o.Enlarge, err = parseBool(value)
+		case "sharpen":
+			o.Sharpen, err = parseBool(value)
+		case "lossless":
+			o.Save.Lossless, err = parseBool(value)
+			losslessGiven = true
+		case "webp":
+			o.Save.AllowWebp, err = parseBool(value)
+		case "avif":
+			o.Save.AllowAvif, err = parseBool(value)
+		default:
+			err = errors.New("unknown parameter")
+		}
+
+		if err != nil {
+			return 0, queryError(key, err)
+		}
+	}
+
+	// Like the path grammar, a crop mode or focal point needs a crop, and
+	// a background color needs padding.
+	for _, key := range []string{"crop", "focus"} {
+		if _, ok := query[key]; ok && !o.Crop {
+			return 0, queryError(key, errors.New("needs fit=crop"))
+		}
+	}
+	if _, ok := query["bg"]; ok && !o.Pad {
+		return 0, queryError("bg", errors.New("needs fit=pad"))
+	}
+
+	// Like the path grammar, crop and pad need both a width and a height.
+	if o.Crop || o.Pad {
+		fit := "crop"
+		if o.Pad {
+			fit = "pad"
+		}
+		if o.Width == 0 {
+			return 0, queryError("w", fmt.Errorf("required by fit=%s", fit))
+		}
+		if o.Height == 0 {
+			return 0, queryError("h", fmt.Errorf("required by fit=%s", fit))
+		}
+	}
+
+	// Clients may turn off, but not turn on, enlarging and lossless
+	// output that the flags don't allow.
+	if o.Enlarge && !*enlarge {
+		return 0, queryError("enlarge", errNotAllowed)
+	}
+	allowLossless := *lossless
+	if o.Save.AllowWebp {
+		allowLossless = *losslessWebp
+	}
+	if losslessGiven && o.Save.Lossless && !allowLossless {
+		return 0, queryError("lossless", errNotAllowed)
+	}
+
+	// Match the "w" path flag's lossless handling unless told otherwise.
+	if o.Save.AllowWebp && !losslessGiven {
+		o.Save.Lossless = *losslessWebp
+	}
+
+	return dpr, nil
+}
+
+func queryError(key string, err error) error {
+	return &thumbnail.StatusError{Status: http.StatusBadRequest, Message: fmt.Sprintf("bad %q parameter: %v", key, err)}
+}
+
+func parseInt(value string, low, high int) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if i < low || i > high {
+		return 0, fmt.Errorf("must be from %d to %d", low, high)
+	}
+	return i, nil
+}
+
+func parseFloat(value string, low, high float64) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errNotNumber
+	}
+	if !(f >= low && f <= high) {
+		return 0, fmt.Errorf("must be from %g to %g", low, high)
+	}
+	return f, nil
+}
+
+// parseFocus parses a focal point given as normalized "x,y" coordinates
+// or the name of a gravity.
+func parseFocus(value string) (thumbnail.FocalPoint, error) {
+	if focus, ok := gravities[strings.ToLower(value)]; ok {
+		return focus, nil
+	}
+
+	xy := strings.Split(value, ",")
+	if len(xy) != 2 {
+		return thumbnail.FocalPoint{}, errFocus
+	}
+	x, err := parseFloat(xy[0], 0, 1)
+	if err != nil {
+		return thumbnail.FocalPoint{}, errFocus
+	}
+	y, err := parseFloat(xy[1], 0, 1)
+	if err != nil {
+		return thumbnail.FocalPoint{}, errFocus
+	}
+
+	return thumbnail.FocalPoint{X: x, Y: y}, nil
+}
+
+// parseColor parses a hex RRGGBB or RRGGBBAA color.  Without alpha, it
+// is opaque.
+func parseColor(value string) (thumbnail.Color, error) {
+	if len(value) != 6 && len(value) != 8 {
+		return thumbnail.Color{}, errColor
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+
+	rgba, err := hex.DecodeString(value)
+	if err != nil {
+		return thumbnail.Color{}, errColor
+	}
+
+	return thumbnail.Color{R: rgba[0], G: rgba[1], B: rgba[2], A: rgba[3]}, nil
+}
+
+func parseBool(value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errNotBool
+	}
+	return b, nil
+}
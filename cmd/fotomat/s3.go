@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+
+	"github.com/die-net/fotomat/v2/s3"
+)
+
+var (
+	s3Bucket    = flag.String("s3_bucket", "", "Fetch original images from this S3 bucket, using the request path as the key (\"\"=proxy instead).")
+	s3Endpoint  = flag.String("s3_endpoint", "", "Base URL of an S3-compatible object store, such as http://localhost:9000 (\"\"=Amazon S3).")
+	s3PathStyle = flag.Bool("s3_path_style", false, "Put the S3 bucket name in the URL path rather than the host name, as most S3-compatible object stores need.")
+	s3Region    = flag.String("s3_region", "us-east-1", "Region of the S3 bucket.")
+)
+
+// newS3Origin returns an Origin for -s3_bucket that sends requests with
+// client, using credentials from the standard AWS environment variables.
+func newS3Origin(client *http.Client) *s3.Origin {
+	return &s3.Origin{
+		Endpoint:     *s3Endpoint,
+		Region:       *s3Region,
+		Bucket:       *s3Bucket,
+		PathStyle:    *s3PathStyle,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Client:       client,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+var (
+	priorityHeader       = flag.String("priority_header", "", "Header that marks a request from -trusted_proxy_networks as background work when it is \"batch\", which is processed only when no other requests are waiting (\"\"=none).")
+	tenantHeader         = flag.String("tenant_header", "", "Header naming the tenant that a request from -trusted_proxy_networks has its image processing shared fairly with other tenants' by (\"\"=the client's address).")
+	tenantWeights        = flag.String("tenant_weights", "", "Comma-separated list of tenant=weight pairs, giving a tenant that many times the share of image processing of a tenant not listed.")
+	trustedProxyNetworks = flag.String("trusted_proxy_networks", "", "Comma-separated list of CIDR networks of front ends trusted to set -priority_header and -tenant_header.")
+)
+
+// trustedProxies is the parsed form of trustedProxyNetworks, set by
+// handleInit.
+var trustedProxies []*net.IPNet
+
+// requestSchedule returns the Priority and tenant that req is processed
+// with.  Only a trusted front end may set them with headers, as anyone
+// else could claim another's tenant, or spread their requests across
+// many.  Otherwise, each client address is a tenant, counting an IPv6 /64
+// network, as is usually given to one site, as one address.
+func requestSchedule(req *http.Request) (thumbnail.Priority, string) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	trusted := false
+	for _, n := range trustedProxies {
+		if ip != nil && n.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+
+	priority := thumbnail.PriorityInteractive
+	if trusted && *priorityHeader != "" && strings.EqualFold(req.Header.Get(*priorityHeader), "batch") {
+		priority = thumbnail.PriorityBatch
+	}
+
+	if trusted && *tenantHeader != "" {
+		if tenant := req.Header.Get(*tenantHeader); tenant != "" {
+			return priority, strings.ToLower(tenant)
+		}
+	}
+
+	switch {
+	case ip == nil:
+		return priority, ""
+	case ip.To4() == nil:
+		return priority, ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	default:
+		return priority, ip.String()
+	}
+}
+
+// parseTenantWeights parses a comma-separated list of tenant=weight pairs.
+func parseTenantWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%q isn't tenant=weight", pair)
+		}
+		weight, err := strconv.Atoi(pair[i+1:])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("bad weight in %q", pair)
+		}
+		weights[strings.ToLower(pair[:i])] = weight
+	}
+
+	return weights, nil
+}
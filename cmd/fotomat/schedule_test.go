@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/die-net/fotomat/v2/thumbnail"
+)
+
+func TestRequestSchedule(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://Images.Example.com/a.jpg=s100x100", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Priority", "batch")
+	req.Header.Set("X-Tenant", "Acme")
+
+	// By default, every request is interactive, and tenants are client
+	// addresses.
+	priority, tenant := requestSchedule(req)
+	assert.Equal(t, thumbnail.PriorityInteractive, priority)
+	assert.Equal(t, "192.0.2.1", tenant)
+
+	// Headers are ignored from clients that aren't trusted.
+	*priorityHeader = "X-Priority"
+	*tenantHeader = "X-Tenant"
+	defer func() {
+		*priorityHeader = ""
+		*tenantHeader = ""
+		trustedProxies = nil
+	}()
+	var err error
+	trustedProxies, err = parseNetworks("10.0.0.0/8")
+	assert.Nil(t, err)
+	priority, tenant = requestSchedule(req)
+	assert.Equal(t, thumbnail.PriorityInteractive, priority)
+	assert.Equal(t, "192.0.2.1", tenant)
+
+	// But used from those that are.
+	req.RemoteAddr = "10.1.2.3:1234"
+	priority, tenant = requestSchedule(req)
+	assert.Equal(t, thumbnail.PriorityBatch, priority)
+	assert.Equal(t, "acme", tenant)
+
+	req.Header.Set("X-Priority", "urgent")
+	req.Header.Del("X-Tenant")
+	priority, tenant = requestSchedule(req)
+	assert.Equal(t, thumbnail.PriorityInteractive, priority)
+	assert.Equal(t, "10.1.2.3", tenant)
+
+	// An IPv6 client's /64 network is one tenant.
+	for _, addr := range []string{"[2001:db8:1:2::1]:1234", "[2001:db8:1:2:ffff::2]:5678"} {
+		req.RemoteAddr = addr
+		_, tenant = requestSchedule(req)
+		assert.Equal(t, "2001:db8:1:2::/64", tenant, addr)
+	}
+}
+
+func TestParseTenantWeights(t *testing.T) {
+	weights, err := parseTenantWeights("")
+	assert.Nil(t, err)
+	assert.Empty(t, weights)
+
+	weights, err = parseTenantWeights("Acme=3, images.example.com=2")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"acme": 3, "images.example.com": 2}, weights)
+
+	for _, bad := range []string{"acme", "acme=0", "acme=x", "acme=-1"} {
+		_, err := parseTenantWeights(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"net/url"
+	"strings"
+)
+
+var signingKeys = flag.String("signing_keys", "", "Comma-separated list of secret keys, any of which may sign URLs with an HMAC-SHA256 \"sig\" parameter (\"\"=don't require signatures).")
+
+// signatureParam is the query parameter holding a URL's signature.
+const signatureParam = "sig"
+
+// urlSigningKeys is the parsed form of signingKeys, set by handleInit.
+var urlSigningKeys [][]byte
+
+func parseSigningKeys(keys string) [][]byte {
+	var parsed [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		if key != "" {
+			parsed = append(parsed, []byte(key))
+		}
+	}
+	return parsed
+}
+
+// signatureMessage returns the portion of a request that is covered by
+// its signature: the lowercased host it was sent to, so a signature can't
+// be replayed against another host, then the path, including any scaling
+// parameters, followed by any other query parameters in canonical order.
+func signatureMessage(host string, u *url.URL) string {
+	message := strings.ToLower(host) + u.Path
+	query := u.Query()
+	query.Del(signatureParam)
+	if len(query) == 0 {
+		return message
+	}
+	return message + "?" + query.Encode()
+}
+
+// sign returns the URL-safe base64 HMAC-SHA256 of message using key.
+func sign(key []byte, message string) string {
+	return base64.RawURLEncoding.EncodeToString(signature(key, message))
+}
+
+func signature(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// validSignature reports whether u, requested from host, has a signature
+// made with any of keys.  Accepting several keys allows them to be rotated
+// without downtime.
+func validSignature(host string, u *url.URL, keys [][]byte) bool {
+	sig, err := base64.RawURLEncoding.DecodeString(u.Query().Get(signatureParam))
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+
+	message := signatureMessage(host, u)
+	for _, key := range keys {
+		if hmac.Equal(sig, signature(key, message)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripSignature removes the signature from u so it isn't sent upstream.
+func stripSignature(u *url.URL) {
+	query := u.Query()
+	if _, ok := query[signatureParam]; !ok {
+		return
+	}
+	query.Del(signatureParam)
+	u.RawQuery = query.Encode()
+}
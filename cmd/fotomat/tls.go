@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	originCAFile   = flag.String("origin_ca_file", "", "PEM file of extra certificate authorities to trust for HTTPS origins without their own ca_file in -origin_map.")
+	originCertFile = flag.String("origin_cert_file", "", "PEM client certificate to present to HTTPS origins without their own cert_file in -origin_map, along with -origin_key_file.")
+	originKeyFile  = flag.String("origin_key_file", "", "PEM private key for -origin_cert_file.")
+)
+
+// originTLS is the TLS settings for connecting to an HTTPS origin: either
+// the defaults from flags, or those given for one in -origin_map.
+type originTLS struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+}
+
+// set sets the setting called key to value, as given in -origin_map.
+func (s *originTLS) set(key, value string) error {
+	switch key {
+	case "ca_file":
+		s.caFile = value
+	case "cert_file":
+		s.certFile = value
+	case "key_file":
+		s.keyFile = value
+	case "server_name":
+		s.serverName = value
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// isZero returns true if s has no settings.
+func (s originTLS) isZero() bool {
+	return s == originTLS{}
+}
+
+// over returns s, with any settings it doesn't have taken from defaults.
+// A client certificate and its key are taken together.  A server name is
+// never taken, as it only suits the origin it was given for.
+func (s originTLS) over(defaults originTLS) originTLS {
+	if s.caFile == "" {
+		s.caFile = defaults.caFile
+	}
+	if s.certFile == "" && s.keyFile == "" {
+		s.certFile, s.keyFile = defaults.certFile, defaults.keyFile
+	}
+	return s
+}
+
+// config returns the tls.Config for s, or nil if it has no settings.
+func (s originTLS) config() (*tls.Config, error) {
+	return originTLSConfig(s.caFile, s.certFile, s.keyFile, s.serverName)
+}
+
+// originTLSConfig returns the TLS settings for connecting to origins: CAs
+// in caFile trusted alongside the system's, a client certificate from
+// certFile and keyFile, and serverName in place of the origin's host name.
+// It returns nil if none are given.
+func originTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginTLSConfig(t *testing.T) {
+	config, err := originTLSConfig("", "", "", "")
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, nil, nil, "Test CA", dir, "ca")
+	server, serverKey := newCertificate(t, ca, caKey, "origin.test", dir, "server")
+	newCertificate(t, ca, caKey, "fotomat", dir, "client")
+
+	// An origin with a certificate from our own CA, for a name other than
+	// its address, that requires a client certificate.
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	origin.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	origin.StartTLS()
+	defer origin.Close()
+
+	for _, test := range []struct {
+		cert       string
+		serverName string
+		ok         bool
+	}{
+		{"client", "origin.test", true},
+		{"", "origin.test", false},
+		{"client", "", false},
+	} {
+		certFile, keyFile := "", ""
+		if test.cert != "" {
+			certFile, keyFile = filepath.Join(dir, test.cert+".crt"), filepath.Join(dir, test.cert+".key")
+		}
+		config, err := originTLSConfig(filepath.Join(dir, "ca.crt"), certFile, keyFile, test.serverName)
+		assert.Nil(t, err)
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(origin.URL)
+		if test.ok && assert.Nil(t, err, "%+v", test) {
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !test.ok {
+			assert.NotNil(t, err, "%+v", test)
+		}
+	}
+
+	// Refuse incomplete or bad settings.
+	_, err = originTLSConfig("", filepath.Join(dir, "client.crt"), "", "")
+	assert.NotNil(t, err)
+	_, err = originTLSConfig(filepath.Join(dir, "client.key"), "", "", "")
+	assert.NotNil(t, err)
+	_, err = originTLSConfig(filepath.Join(dir, "missing.crt"), "", "", "")
+	assert.NotNil(t, err)
+}
+
+func TestOriginMapTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, nil, nil, "Test CA", dir, "ca")
+	server, serverKey := newCertificate(t, ca, caKey, "origin.test", dir, "server")
+	newCertificate(t, ca, caKey, "fotomat", dir, "client")
+
+	// Two origins with certificates for a name other than their address,
+	// where only the first is mapped with that name, and requires a
+	// client certificate.
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	start := func(clientAuth tls.ClientAuthType) *httptest.Server {
+		origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		origin.TLS = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+			ClientAuth:   clientAuth,
+			ClientCAs:    pool,
+		}
+		origin.StartTLS()
+		return origin
+	}
+	mapped, other := start(tls.RequireAndVerifyClientCert), start(tls.NoClientCert)
+	defer mapped.Close()
+	defer other.Close()
+
+	routes, err := parseOriginMap(fmt.Sprintf("/mapped=%s;server_name=origin.test;cert_file=%s;key_file=%s,/other=%s",
+		mapped.URL, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), other.URL))
+	assert.Nil(t, err)
+	allowed, err := parseNetworks("127.0.0.0/8")
+	assert.Nil(t, err)
+	origin, err := newOrigin(allowed, routes, originTLS{caFile: filepath.Join(dir, "ca.crt")})
+	assert.Nil(t, err)
+
+	for _, test := range []struct {
+		path string
+		ok   bool
+	}{
+		{"/mapped/a.jpg", true},
+		// The other origin's address doesn't match its certificate,
+		// and the mapped origin's server name isn't used for it.
+		{"/other/a.jpg", false},
+	} {
+		req, err := http.NewRequest("GET", "http://img.example.com"+test.path, http.NoBody)
+		assert.Nil(t, err)
+		assert.Nil(t, routeOrigin(req, routes, nil, "http"))
+
+		resp, err := origin.Do(req)
+		if test.ok && assert.Nil(t, err, test.path) {
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !test.ok {
+			assert.NotNil(t, err, test.path)
+		}
+	}
+
+	// Refuse different settings for the same origin.
+	routes, err = parseOriginMap(fmt.Sprintf("/a=%s;server_name=origin.test,/b=%s;server_name=other.test", mapped.URL, mapped.URL))
+	assert.Nil(t, err)
+	_, err = newOrigin(allowed, routes, originTLS{})
+	assert.NotNil(t, err)
+}
+
+// newCertificate creates a certificate for name, signed by parent, or
+// self-signed if parent is nil, and writes it and its key as PEM to
+// dir/file.crt and dir/file.key.
+func newCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name, dir, file string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, file+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, file+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+
+	return cert, key
+}
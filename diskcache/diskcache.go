@@ -0,0 +1,233 @@
+// Package diskcache is a least-recently-used cache of byte slices, kept
+// as files in a directory so that it survives restarts.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempPrefix starts the name of a file that is still being written.
+const tempPrefix = ".tmp-"
+
+// Cache is a least-recently-used cache that stores each value in its own
+// file, up to a total size in bytes.  Values are written to a temporary
+// file and renamed into place, so a crash never leaves a partial value,
+// and the file modification times record recent use across restarts.
+// Must be created with New.
+type Cache struct {
+	// Sync flushes each value to disk before renaming it into place, so
+	// that it also survives a power failure intact.  This makes Set much
+	// slower, and is rarely worth it for a cache.
+	Sync bool
+
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Of *entry, most recently used first.
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	name string
+	size int64
+}
+
+// New returns a Cache that keeps at most maxBytes of values in dir,
+// creating dir if needed.  Values already in dir from a previous Cache
+// are kept, in the order they were last used, and partially written ones
+// are removed.
+func New(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	type found struct {
+		entry
+		used time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return os.Remove(path)
+		}
+		if len(d.Name()) != 2*sha256.Size || c.path(d.Name()) != path {
+			return nil // Not one of ours.
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, found{entry{name: d.Name(), size: info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.add(f.entry)
+	}
+
+	return c, nil
+}
+
+// Get returns the value stored for key, if any, and marks it as recently
+// used.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	name := fileName(key)
+
+	c.mu.Lock()
+	el, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := c.path(name)
+	value, err := os.ReadFile(path)
+	if err != nil {
+		// Removed from under us; forget it.
+		c.forget(name, el)
+		return nil, false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return value, true
+}
+
+// Set stores value for key, replacing any previous value and evicting
+// the least recently used values to stay within the size limit.  Values
+// larger than the whole cache, or that can't be written, are dropped.
+func (c *Cache) Set(key string, value []byte) {
+	size := int64(len(value))
+	if size > c.maxBytes {
+		return
+	}
+
+	name := fileName(key)
+	path := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+
+	temp, err := writeTemp(filepath.Dir(path), value, c.Sync)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(temp, path); err != nil {
+		_ = os.Remove(temp)
+		return
+	}
+
+	if el, ok := c.entries[name]; ok {
+		c.size -= el.Value.(*entry).size
+		c.lru.Remove(el)
+		delete(c.entries, name)
+	}
+	c.add(entry{name: name, size: size})
+}
+
+// Size returns the total size in bytes of the values in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// add records e as the most recently used entry, and evicts the least
+// recently used ones while over the size limit.  Must hold mu.
+func (c *Cache) add(e entry) {
+	c.entries[e.name] = c.lru.PushFront(&e)
+	c.size += e.size
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// forget removes el, which was found for name, unless name has since
+// been set again and el is no longer its entry.
+func (c *Cache) forget(name string, el *list.Element) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cur, ok := c.entries[name]; ok && cur == el {
+		c.remove(el)
+	}
+}
+
+// remove forgets el and deletes its file.  Must hold mu.
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	_ = os.Remove(c.path(e.name))
+}
+
+// path returns where the file called name is kept, spread across
+// subdirectories to keep each one small.
+func (c *Cache) path(name string) string {
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// fileName returns the name of the file holding key's value.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeTemp writes value to a new temporary file in dir, flushed to disk
+// if sync is set, and returns its path.
+func writeTemp(dir string, value []byte, sync bool) (string, error) {
+	f, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(value)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
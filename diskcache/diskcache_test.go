@@ -0,0 +1,134 @@
+package diskcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSet(t *testing.T) {
+	c, err := New(t.TempDir(), 100)
+	assert.Nil(t, err)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Set("a", []byte("apple"))
+	c.Set("b", []byte("banana"))
+	assertValue(t, c, "a", "apple")
+	assertValue(t, c, "b", "banana")
+	assert.Equal(t, int64(11), c.Size())
+
+	// Replacing a value replaces its size.
+	c.Set("a", []byte("apricot"))
+	assertValue(t, c, "a", "apricot")
+	assert.Equal(t, int64(13), c.Size())
+
+	// Values larger than the cache are dropped.
+	c.Set("c", make([]byte, 101))
+	_, ok = c.Get("c")
+	assert.False(t, ok)
+}
+
+func TestEviction(t *testing.T) {
+	c, err := New(t.TempDir(), 30)
+	assert.Nil(t, err)
+
+	c.Set("a", make([]byte, 10))
+	c.Set("b", make([]byte, 10))
+	c.Set("c", make([]byte, 10))
+
+	// Using "a" makes "b" the least recently used.
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+	c.Set("d", make([]byte, 10))
+
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok = c.Get(key)
+		assert.True(t, ok, key)
+	}
+	assert.Equal(t, int64(30), c.Size())
+}
+
+func TestRestart(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 30)
+	assert.Nil(t, err)
+
+	c.Set("a", []byte("apple"))
+	c.Set("b", []byte("banana"))
+
+	// Make "a" the most recently used, as seen by the next Cache.
+	old := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(c.path(fileName("b")), old, old))
+
+	// Partially written values are removed.
+	temp := filepath.Join(dir, tempPrefix+"partial")
+	assert.Nil(t, os.WriteFile(temp, []byte("x"), 0o644))
+
+	c, err = New(dir, 30)
+	assert.Nil(t, err)
+	assertValue(t, c, "a", "apple")
+	assertValue(t, c, "b", "banana")
+	assert.Equal(t, int64(11), c.Size())
+	_, err = os.Stat(temp)
+	assert.True(t, os.IsNotExist(err))
+
+	// Reopening with a smaller limit evicts the least recently used.
+	assert.Nil(t, os.Chtimes(c.path(fileName("b")), old, old))
+	c, err = New(dir, 6)
+	assert.Nil(t, err)
+	assertValue(t, c, "a", "apple")
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+}
+
+func TestRemovedFile(t *testing.T) {
+	c, err := New(t.TempDir(), 100)
+	assert.Nil(t, err)
+
+	c.Set("a", []byte("apple"))
+	assert.Nil(t, os.Remove(c.path(fileName("a"))))
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), c.Size())
+}
+
+func TestRemovedFileReplaced(t *testing.T) {
+	c, err := New(t.TempDir(), 100)
+	assert.Nil(t, err)
+
+	// A failed read of an entry that has since been replaced doesn't
+	// remove its replacement.
+	c.Set("a", []byte("apple"))
+	c.mu.Lock()
+	el := c.entries[fileName("a")]
+	c.mu.Unlock()
+	c.Set("a", []byte("avocado"))
+	c.forget(fileName("a"), el)
+
+	assertValue(t, c, "a", "avocado")
+	assert.Equal(t, int64(7), c.Size())
+}
+
+func TestSync(t *testing.T) {
+	c, err := New(t.TempDir(), 100)
+	assert.Nil(t, err)
+	c.Sync = true
+
+	c.Set("a", []byte("apple"))
+	assertValue(t, c, "a", "apple")
+}
+
+func assertValue(t *testing.T, c *Cache, key, want string) {
+	value, ok := c.Get(key)
+	if assert.True(t, ok, key) {
+		assert.Equal(t, want, string(value), key)
+	}
+}
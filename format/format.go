@@ -2,7 +2,9 @@ package format
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"sync"
 
 	"github.com/die-net/fotomat/v2/vips"
 )
@@ -27,6 +29,8 @@ const (
 	Tiff
 	Pdf
 	Svg
+	Avif
+	Heif
 )
 
 var formatInfo = []struct {
@@ -34,6 +38,8 @@ var formatInfo = []struct {
 	isFormat  func([]byte) bool
 	loadFile  func(filename string) (*vips.Image, error)
 	loadBytes func([]byte) (*vips.Image, error)
+	// needs is an optional VIPS operation that loading depends on.
+	needs *operation
 }{
 	{mime: "application/octet-stream", isFormat: nil, loadFile: nil, loadBytes: nil},
 	{mime: "image/jpeg", isFormat: isJpeg, loadFile: vips.Jpegload, loadBytes: vips.JpegloadBuffer},
@@ -43,8 +49,13 @@ var formatInfo = []struct {
 	{mime: "image/tiff", isFormat: isTiff, loadFile: vips.Tiffload, loadBytes: vips.TiffloadBuffer},
 	{mime: "application/pdf", isFormat: isPdf, loadFile: vips.Pdfload, loadBytes: vips.PdfloadBuffer},
 	{mime: "image/svg+xml", isFormat: isSvg, loadFile: vips.Svgload, loadBytes: vips.SvgloadBuffer},
+	{mime: "image/avif", isFormat: isAvif, loadFile: vips.Heifload, loadBytes: vips.HeifloadBuffer, needs: heifload},
+	{mime: "image/heif", isFormat: isHeif, loadFile: vips.Heifload, loadBytes: vips.HeifloadBuffer, needs: heifload},
 }
 
+// heifload is only present if VIPS was built with libheif.
+var heifload = &operation{nickname: "heifload_buffer"}
+
 func isJpeg(blob []byte) bool {
 	return bytes.HasPrefix(blob, []byte("\xFF\xD8\xFF"))
 }
@@ -81,6 +92,42 @@ func isSvg(blob []byte) bool {
 	return bytes.Contains(blob[:min(1000, len(blob))], []byte("<svg"))
 }
 
+func isAvif(blob []byte) bool {
+	return hasBrand(blob, "avif", "avis")
+}
+
+func isHeif(blob []byte) bool {
+	return !isAvif(blob) && hasBrand(blob, "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1")
+}
+
+// hasBrand reports whether blob starts with an ISO base media file "ftyp"
+// box whose major or compatible brands include any of brands.
+func hasBrand(blob []byte, brands ...string) bool {
+	if len(blob) < 16 || !bytes.Equal(blob[4:8], []byte("ftyp")) {
+		return false
+	}
+
+	size := int(binary.BigEndian.Uint32(blob[:4]))
+	if size < 16 || size > len(blob) {
+		return false
+	}
+
+	// The major brand is followed by a minor version and then any
+	// number of compatible brands.
+	for i := 8; i+4 <= size; i += 4 {
+		if i == 12 {
+			continue
+		}
+		for _, brand := range brands {
+			if string(blob[i:i+4]) == brand {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func min(x, y int) int {
 	if y < x {
 		return y
@@ -106,18 +153,25 @@ func (format Format) String() string {
 
 // CanLoadFile returns true if we know how to load this format from a file.
 func (format Format) CanLoadFile() bool {
-	return formatInfo[format].loadFile != nil
+	return formatInfo[format].loadFile != nil && format.available()
 }
 
 // CanLoadBytes returns true if we know how to load this format from a byte slice.
 func (format Format) CanLoadBytes() bool {
-	return formatInfo[format].loadBytes != nil
+	return formatInfo[format].loadBytes != nil && format.available()
+}
+
+// available returns false if VIPS lacks an optional library this format
+// needs, such as libheif for HEIF and AVIF.
+func (format Format) available() bool {
+	needs := formatInfo[format].needs
+	return needs == nil || needs.ok()
 }
 
 // LoadFile loads a file in a given Format and returns an Image.
 func (format Format) LoadFile(filename string) (*vips.Image, error) {
 	loadFile := formatInfo[format].loadFile
-	if loadFile == nil {
+	if loadFile == nil || !format.available() {
 		return nil, ErrInvalidOperation
 	}
 
@@ -127,9 +181,23 @@ func (format Format) LoadFile(filename string) (*vips.Image, error) {
 // LoadBytes loads byte slice in a given format and returns an Image.
 func (format Format) LoadBytes(blob []byte) (*vips.Image, error) {
 	loadBytes := formatInfo[format].loadBytes
-	if loadBytes == nil {
+	if loadBytes == nil || !format.available() {
 		return nil, ErrInvalidOperation
 	}
 
 	return loadBytes(blob)
 }
+
+// operation lazily checks whether VIPS has an optional operation.
+type operation struct {
+	nickname  string
+	once      sync.Once
+	available bool
+}
+
+func (o *operation) ok() bool {
+	o.once.Do(func() {
+		o.available = vips.HasOperation(o.nickname)
+	})
+	return o.available
+}
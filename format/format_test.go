@@ -39,6 +39,16 @@ func TestMetadataValidation(t *testing.T) {
 	assert.Nil(t, isSize(image("2px.tiff"), Tiff, 2, 3))
 	assert.Nil(t, isSize(image("2px.svg"), Svg, 2, 3))
 	assert.Nil(t, isSize(image("2px.pdf"), Pdf, 2, 3))
+
+	if !Heif.CanLoadBytes() {
+		t.Log("Skipping HEIC and AVIF input: VIPS was built without libheif.")
+		return
+	}
+	assert.Nil(t, isSize(image("2px.heic"), Heif, 2, 3))
+	assert.Nil(t, isSize(image("2px.avif"), Avif, 2, 3))
+
+	// A HEIC's rotation has already been applied, despite its EXIF orientation.
+	assert.Nil(t, isSize(image("orient6.heic"), Heif, 48, 80))
 }
 
 func metadataError(filename string) error {
@@ -152,6 +162,71 @@ func TestSwitchToLossy(t *testing.T) {
 	}
 }
 
+func TestSaveHeif(t *testing.T) {
+	if !Avif.CanSave() {
+		t.Skip("Skipping AVIF and HEIF output: VIPS was built without libheif.")
+	}
+
+	img := image("flowers.png")
+
+	// AVIF is preferred over WebP, and HEIF is only used if requested.
+	for _, test := range []struct {
+		so    SaveOptions
+		brand string
+	}{
+		{SaveOptions{AllowAvif: true}, "avif"},
+		{SaveOptions{AllowAvif: true, AllowWebp: true}, "avif"},
+		{SaveOptions{Format: Avif, Effort: 9}, "avif"},
+		{SaveOptions{Format: Heif}, "heic"},
+	} {
+		thumb := convert(img, test.so)
+		assert.Equal(t, "ftyp"+test.brand, string(thumb[4:12]), "options: %+v", test.so)
+	}
+
+	// Lower quality should be smaller, and lossless should be larger.
+	size := len(convert(img, SaveOptions{Format: Avif}))
+	assert.True(t, len(convert(img, SaveOptions{Format: Avif, Quality: 20})) < size)
+	assert.True(t, len(convert(img, SaveOptions{Format: Avif, Lossless: true})) > size)
+}
+
+func TestSaveGifFallback(t *testing.T) {
+	// Pretend that VIPS was built without cgif.
+	saved := gifsave
+	gifsave = &operation{nickname: "no_such_operation"}
+	defer func() { gifsave = saved }()
+	assert.False(t, Gif.CanSave())
+
+	save := func(so SaveOptions) ([]byte, error) {
+		img, err := vips.GifloadBufferAnimated(image("animated.gif"))
+		if err != nil {
+			return nil, err
+		}
+		defer img.Close()
+
+		return Save(img, so)
+	}
+
+	// An animation is kept as WebP if that's allowed.
+	thumb, err := save(SaveOptions{Format: Gif, AllowWebp: true})
+	if assert.Nil(t, err) {
+		assert.Equal(t, Webp, DetectFormat(thumb))
+	}
+
+	// Otherwise only the first frame is kept.
+	for _, so := range []SaveOptions{{Format: Gif}, {}} {
+		thumb, err = save(so)
+		if assert.Nil(t, err, "options: %+v", so) {
+			m, err := MetadataBytes(thumb)
+			if assert.Nil(t, err, "options: %+v", so) {
+				assert.NotEqual(t, Gif, m.Format, "options: %+v", so)
+				assert.Equal(t, 64, m.Width, "options: %+v", so)
+				assert.Equal(t, 48, m.Height, "options: %+v", so)
+				assert.Equal(t, 1, m.Pages, "options: %+v", so)
+			}
+		}
+	}
+}
+
 func convert(blob []byte, so SaveOptions) []byte {
 	format := DetectFormat(blob)
 	img, err := format.LoadBytes(blob)
@@ -11,6 +11,9 @@ type Metadata struct {
 	Format      Format
 	Orientation Orientation
 	HasAlpha    bool
+	// Pages is the number of frames in an animated image, or pages in
+	// a document, even if only the first was loaded.
+	Pages int
 }
 
 // MetadataBytes parses an image byte slice and returns Metadata or an error.
@@ -54,11 +57,12 @@ func metadataImageFormat(image *vips.Image, format Format) Metadata {
 }
 
 // MetadataImage returns Metadata from an Image. Format is always unset.
+// The Height of an Image with several pages loaded is that of one page.
 func MetadataImage(image *vips.Image) Metadata {
 	o := DetectOrientation(image)
-	w, h := o.Dimensions(image.Xsize(), image.Ysize())
+	w, h := o.Dimensions(image.Xsize(), image.ImageGetPageHeight())
 	if w <= 0 || h <= 0 {
 		panic("Invalid image dimensions.")
 	}
-	return Metadata{Width: w, Height: h, Orientation: o, HasAlpha: image.HasAlpha()}
+	return Metadata{Width: w, Height: h, Orientation: o, HasAlpha: image.HasAlpha(), Pages: image.ImageGetNPages()}
 }
@@ -11,21 +11,35 @@ const (
 	DefaultQuality = 85
 	// DefaultCompression is used when SaveOptions.Compression is unspecified.
 	DefaultCompression = 6
+	// DefaultEffort is used when SaveOptions.Effort is unspecified.
+	DefaultEffort = 4
 )
 
 // ErrInvalidSaveFormat is returned if the specified Format can't be written to.
 var ErrInvalidSaveFormat = errors.New("invalid save format")
 
+var (
+	// heifsave is only present if VIPS was built with libheif.
+	heifsave = &operation{nickname: "heifsave_buffer"}
+	// gifsave is only present if VIPS was built with cgif.
+	gifsave = &operation{nickname: "gifsave_buffer"}
+)
+
 // SaveOptions specifies how an image should be saved.
 type SaveOptions struct {
 	// Format is the Format that an image is saved in. If unspecified, the best output format for a given input image is selected.
 	Format Format
-	// JPEG or WebP quality for an output image (1-100).
+	// JPEG, WebP, AVIF, or HEIF quality for an output image (1-100).
 	Quality int
 	// Compress is the GZIP compression setting to use for PNG images (1-9).
 	Compression int
+	// Effort is the CPU effort to spend making AVIF or HEIF images smaller (1-9).
+	Effort int
 	// AllowWebp allows automatic selection of WebP format, if reader can support it.
 	AllowWebp bool
+	// AllowAvif allows automatic selection of AVIF format, if reader can
+	// support it.  It is preferred over WebP.
+	AllowAvif bool
 	// Lossless allows selection of a lossless output format.
 	Lossless bool
 	// LossyIfPhoto uses a lossy format if it detects that an image is a photo.
@@ -42,9 +56,27 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		options.Compression = DefaultCompression
 	}
 
+	if options.Effort < 1 || options.Effort > 9 {
+		options.Effort = DefaultEffort
+	}
+
+	// An animation can only be kept as a GIF or WebP.
+	animated := image.ImageGetPageHeight() < image.Ysize()
+
+	// Without cgif, VIPS can't write GIFs, so pick another format.
+	if options.Format == Gif && !Gif.CanSave() {
+		options.Format = Unknown
+	}
+
 	// Make a decision on image format and whether we're using lossless.
 	if options.Format == Unknown {
 		switch {
+		case animated && options.AllowWebp:
+			options.Format = Webp
+		case animated && Gif.CanSave():
+			options.Format = Gif
+		case options.AllowAvif && Avif.CanSave():
+			options.Format = Avif
 		case options.AllowWebp:
 			options.Format = Webp
 		case image.HasAlpha() || useLossless(image, options):
@@ -54,19 +86,54 @@ func Save(image *vips.Image, options SaveOptions) ([]byte, error) {
 		}
 	}
 
+	// Other formats get the first frame.
+	if animated && options.Format != Gif && options.Format != Webp {
+		if err := image.ExtractArea(0, 0, image.Xsize(), image.ImageGetPageHeight()); err != nil {
+			return nil, err
+		}
+	}
+
+	if !options.Format.CanSave() {
+		return nil, ErrInvalidSaveFormat
+	}
+
 	switch options.Format {
 	case Jpeg:
 		return jpegSave(image, options)
 	case Png:
 		return pngSave(image, options)
+	case Gif:
+		return image.GifsaveBuffer()
 	case Webp:
 		options.Lossless = useLossless(image, options)
 		return webpSave(image, options)
+	case Avif:
+		options.Lossless = useLossless(image, options)
+		return heifSave(image, options, vips.HeifCompressionAv1)
+	case Heif:
+		options.Lossless = useLossless(image, options)
+		return heifSave(image, options, vips.HeifCompressionHevc)
 	default:
 		return nil, ErrInvalidSaveFormat
 	}
 }
 
+// CanSave returns true if we know how to save this format.  AVIF and HEIF
+// need VIPS to be built with libheif, and GIF needs it to be built with
+// cgif.
+func (format Format) CanSave() bool {
+	switch format {
+	case Jpeg, Png, Webp:
+		return true
+	case Gif:
+		return gifsave.ok()
+	case Avif, Heif:
+		return heifsave.ok()
+	default:
+		return false
+	}
+}
+
 func jpegSave(image *vips.Image, options SaveOptions) ([]byte, error) {
 	// JPEG interlace saves 2-3%, but incurs a few hundred bytes of
 	// overhead, requires buffering the image completely in RAM for
@@ -89,6 +156,10 @@ func webpSave(image *vips.Image, options SaveOptions) ([]byte, error) {
 	return image.WebpsaveBuffer(options.Quality, options.Lossless)
 }
 
+func heifSave(image *vips.Image, options SaveOptions, compression vips.HeifCompression) ([]byte, error) {
+	return image.HeifsaveBuffer(options.Quality, options.Lossless, compression, options.Effort)
+}
+
 func useLossless(image *vips.Image, options SaveOptions) bool {
 	if !options.Lossless {
 		return false
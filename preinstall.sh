@@ -8,6 +8,7 @@ set -euo pipefail
 # Usage: sudo ./preinstall.sh
 
 VIPS_VERSION=${VIPS_VERSION:-8.13.3}
+CGIF_VERSION=${CGIF_VERSION:-0.3.2}
 GO_VERSION=${GO_VERSION:-1.20.5}
 
 export PATH="/usr/local/bin:/usr/bin:/bin:${PATH-}"
@@ -49,11 +50,16 @@ case "$release" in
         apt-get -q update
         apt-get install -y -q --no-install-recommends automake build-essential ca-certificates curl git libexif-dev libexpat1-dev libffi-dev libfftw3-dev libgif-dev libglib2.0-dev libjpeg-dev liblcms2-dev libpng12-dev libpoppler-glib-dev librsvg2-dev libselinux1-dev libtiff5-dev libwebp-dev libxml2-dev tar
         ;;
-    debian-9 | debian-10 | debian-unknown | ubuntu-1[789].* | ubuntu-2[0-9].* | mint-1[89].* | mint-2[0-9].*)
-        # Debian 9, 10, or sid, Ubuntu 17-, Mint 18-
+    debian-9 | debian-10 | ubuntu-1[789].* | mint-1[89].*)
+        # Debian 9-10, Ubuntu 17-18, Mint 18-19; their libheif is too old for AVIF
         apt-get -q update
         apt-get install -y -q --no-install-recommends automake build-essential ca-certificates curl git libexif-dev libexpat1-dev libffi-dev libfftw3-dev libgif-dev libglib2.0-dev libjpeg-dev liblcms2-dev libmount-dev libpng-dev libpoppler-glib-dev librsvg2-dev libselinux1-dev libtiff5-dev libwebp-dev libxml2-dev libzstd-dev tar
         ;;
+    debian-1[1-9] | debian-unknown | ubuntu-2[0-9].* | mint-2[0-9].*)
+        # Debian 11- or sid, Ubuntu 20-, Mint 20-
+        apt-get -q update
+        apt-get install -y -q --no-install-recommends automake build-essential ca-certificates curl git libaom-dev libexif-dev libexpat1-dev libffi-dev libfftw3-dev libgif-dev libglib2.0-dev libheif-dev libjpeg-dev liblcms2-dev libmount-dev libpng-dev libpoppler-glib-dev librsvg2-dev libselinux1-dev libtiff5-dev libwebp-dev libxml2-dev libzstd-dev meson ninja-build tar
+        ;;
     amzn-* | centos-7* | ol-7* | rhel-7* | scientific-7*)
         # RHEL/CentOS/SL 7/Amazon Linux 2/Oracle Linux 7
         yum -y update
@@ -74,6 +80,26 @@ if ! type pkg-config >/dev/null; then
     echo "Sorry, I don't yet know how to install on a system without pkg-config"
 fi
 
+# VIPS needs cgif to write GIFs, and few distributions package it yet.
+if pkg-config --exists cgif; then
+    echo "Found cgif $(pkg-config --modversion cgif) installed"
+elif [[ $CGIF_VERSION == "skip" ]] || ! type meson ninja >/dev/null 2>&1; then
+    echo "Skipping cgif installation; GIFs will be saved as another format"
+else
+    url="https://github.com/dloebl/cgif/archive/refs/tags/V${CGIF_VERSION}.tar.gz"
+    echo "Building cgif $CGIF_VERSION from source $url"
+    rm -rf cgif-$CGIF_VERSION || true
+    mkdir cgif-$CGIF_VERSION
+    curl -sSL "$url" | tar --strip-components=1 -C cgif-$CGIF_VERSION -xzf -
+    cd cgif-$CGIF_VERSION
+    meson setup --prefix=/usr/local --libdir=lib --buildtype=release build
+    ninja -C build install
+    cd ..
+    rm -rf cgif-$CGIF_VERSION
+    ldconfig
+    echo "Installed cgif $(pkg-config --modversion cgif)"
+fi
+
 if pkg-config --exists vips && pkg-config --atleast-version=$VIPS_VERSION vips; then
     echo "Found libvips $(pkg-config --modversion vips) installed"
 elif [[ $VIPS_VERSION == "skip" ]]; then
@@ -92,7 +118,7 @@ else
         --without-openslide --without-orc --without-pangoft2 --without-ppm \
         --without-radiance --without-x \
         --with-OpenEXR --with-jpeg --with-lcms --with-libexif --with-giflib \
-        --with-libwebp --with-png --with-poppler --with-rsvg --with-tiff \
+        --with-cgif --with-heif --with-libwebp --with-png --with-poppler --with-rsvg --with-tiff \
         ${VIPS_OPTIONS-}
     make -j "$(getconf _NPROCESSORS_ONLN 2>/dev/null || echo 1)"
     make install
@@ -0,0 +1,205 @@
+// Package s3 fetches original images from Amazon S3 or a compatible object
+// store, such as MinIO, signing requests with AWS Signature Version 4.
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// emptyHash is the hex SHA-256 of an empty request body.
+	emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// timeFormat is the format of the X-Amz-Date header.
+	timeFormat = "20060102T150405Z"
+	algorithm  = "AWS4-HMAC-SHA256"
+)
+
+// ErrNoBucket is returned if Origin.Bucket isn't set.
+var ErrNoBucket = errors.New("s3: no bucket specified")
+
+// Origin fetches objects from a bucket, using each request's URL path as
+// the object's key.  It can be used as a thumbnail.Origin.
+type Origin struct {
+	// Endpoint is the base URL of the object store, such as
+	// "http://localhost:9000".  The default is Amazon S3 in Region.
+	Endpoint string
+	// Region is where the bucket is, as used in signatures.
+	Region string
+	// Bucket is the name of the bucket.
+	Bucket string
+	// PathStyle puts the bucket name in the URL path, rather than in the
+	// host name.  Most object stores other than Amazon S3 need it.
+	PathStyle bool
+	// AccessKey and SecretKey are the credentials to sign requests with,
+	// along with SessionToken if they are temporary.  Without AccessKey,
+	// requests are anonymous.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client sends the requests (nil=http.DefaultClient).
+	Client *http.Client
+
+	now func() time.Time // For testing.
+}
+
+// Do fetches the object named by req's URL path, passing on req's
+// headers and Context.
+func (o *Origin) Do(req *http.Request) (*http.Response, error) {
+	if o.Bucket == "" {
+		return nil, ErrNoBucket
+	}
+
+	u, err := o.objectURL(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := http.NewRequestWithContext(req.Context(), req.Method, u.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range req.Header {
+		r.Header[key] = values
+	}
+
+	if o.AccessKey != "" {
+		now := time.Now
+		if o.now != nil {
+			now = o.now
+		}
+		o.sign(r, now().UTC())
+	}
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(r)
+}
+
+// objectURL returns the URL of the object called key.
+func (o *Origin) objectURL(key string) (*url.URL, error) {
+	endpoint := o.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + o.Region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + key
+	if o.PathStyle {
+		path = "/" + o.Bucket + path
+	} else {
+		u.Host = o.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+
+	return u, nil
+}
+
+// sign adds Signature Version 4 authentication to r, made at t, covering
+// its host and X-Amz-* headers.
+func (o *Origin) sign(r *http.Request, t time.Time) {
+	amzDate := t.Format(timeFormat)
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", emptyHash)
+	if o.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", o.SessionToken)
+	}
+
+	// Canonical headers are lower case and sorted.
+	values := map[string]string{"host": r.URL.Host}
+	for key := range r.Header {
+		if lower := strings.ToLower(key); strings.HasPrefix(lower, "x-amz-") {
+			values[lower] = strings.TrimSpace(r.Header.Get(key))
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		signedHeaders,
+		emptyHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + o.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, hashHex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+o.SecretKey), date)
+	key = hmacSHA256(key, o.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", algorithm+" Credential="+o.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery returns query sorted and encoded for a signature.
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything in s but unreserved characters and,
+// unless encodeSlash is set, "/", as signatures require.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
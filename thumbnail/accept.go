@@ -0,0 +1,49 @@
+package thumbnail
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/die-net/fotomat/v2/format"
+)
+
+// negotiateFormat allows output formats that the client explicitly lists in
+// its Accept header(s). Wildcards are ignored, as browsers that send
+// "image/*" don't necessarily support newer formats.  If WebP wasn't
+// already allowed, Lossless is replaced with losslessWebp.
+func negotiateFormat(accept []string, o format.SaveOptions, losslessWebp bool) format.SaveOptions {
+	if !o.AllowWebp && acceptsType(accept, format.Webp.String()) {
+		o.AllowWebp = true
+		o.Lossless = losslessWebp
+	}
+	if acceptsType(accept, format.Avif.String()) {
+		o.AllowAvif = true
+	}
+
+	return o
+}
+
+// acceptsType returns true if the Accept header values list mimeType with a
+// non-zero quality.
+func acceptsType(accept []string, mimeType string) bool {
+	for _, value := range accept {
+		for _, mediaRange := range strings.Split(value, ",") {
+			params := strings.Split(mediaRange, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), mimeType) {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+					q, _ = strconv.ParseFloat(kv[1], 64)
+				}
+			}
+
+			return q > 0
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,170 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache stores thumbnails for a Proxy, so that repeated requests don't
+// need to fetch and process the original image again.  Implementations
+// must be safe for concurrent use, and may drop values at any time.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// cachedHeaders are the upstream response headers kept with a cached
+// thumbnail, and sent with it.
+var cachedHeaders = []string{"Cache-Control", "Date", "Etag", "Expires", "Last-Modified"}
+
+// cacheEntry is a thumbnail stored in a Cache.
+type cacheEntry struct {
+	// Header holds cachedHeaders from the upstream response.
+	Header http.Header
+	// Stored is when the upstream response was received, less its Age.
+	Stored time.Time
+	// Expires is when the entry needs revalidating with upstream.
+	Expires time.Time
+	Thumb   []byte
+}
+
+// cacheKey returns the key for the thumbnail of url made with options.
+// The upstream validators aren't part of it, but are kept in the entry
+// and checked with upstream before a stale entry is used.
+func cacheKey(url string, options Options) string {
+	// Timeouts and scheduling don't change the thumbnail.
+	options.MaxQueueDuration = 0
+	options.MaxProcessingDuration = 0
+	options.AbortGracePeriod = 0
+	options.MaxStuck = 0
+	options.StuckWindow = 0
+	options.Priority = PriorityInteractive
+	options.Tenant = ""
+	return fmt.Sprintf("%s %+v", url, options)
+}
+
+// newCacheEntry returns an entry for thumb, made from an upstream
+// response with header received at now, or nil if it can't be cached.
+func newCacheEntry(header http.Header, thumb []byte, now time.Time) *cacheEntry {
+	e := &cacheEntry{Header: http.Header{}, Thumb: thumb}
+	if !e.update(header, now) {
+		return nil
+	}
+	return e
+}
+
+// update refreshes e from an upstream response with header, received at
+// now, that either contained or revalidated it.  It returns false if e
+// may no longer be cached.
+func (e *cacheEntry) update(header http.Header, now time.Time) bool {
+	copyHeaders(header, e.Header, cachedHeaders)
+
+	lifetime, ok := cacheLifetime(e.Header)
+	age, _ := strconv.Atoi(header.Get("Age"))
+	e.Stored = now.Add(-time.Duration(age) * time.Second)
+	e.Expires = e.Stored.Add(lifetime)
+
+	return ok
+}
+
+// fresh returns true if e can be used at now without revalidating it.
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// age returns the Age header for e, sent at now.
+func (e *cacheEntry) age(now time.Time) string {
+	return strconv.Itoa(int(now.Sub(e.Stored) / time.Second))
+}
+
+// revalidate returns the request header to send upstream to check
+// whether e is still current, based on the client's header.
+func (e *cacheEntry) revalidate(header http.Header) http.Header {
+	header = header.Clone()
+	header.Del("If-None-Match")
+	header.Del("If-Modified-Since")
+	if etag := e.Header.Get("Etag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastMod := e.Header.Get("Last-Modified"); lastMod != "" {
+		header.Set("If-Modified-Since", lastMod)
+	}
+	return header
+}
+
+func (e *cacheEntry) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCacheEntry(b []byte) (*cacheEntry, error) {
+	var e cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// cacheLifetime returns how long an upstream response with header stays
+// fresh, and whether it may be cached at all.  A response without a
+// lifetime is still worth caching if it can be revalidated.
+func cacheLifetime(header http.Header) (time.Duration, bool) {
+	maxAge, sharedMaxAge := -1, -1
+	noCache := false
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value := directive, ""
+		if i := strings.IndexByte(directive, '='); i >= 0 {
+			name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "no-store", "private":
+			return 0, false
+		case "no-cache":
+			noCache = true
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sharedMaxAge = parseSeconds(value)
+		}
+	}
+
+	var lifetime time.Duration
+	switch {
+	case noCache:
+	case sharedMaxAge >= 0:
+		lifetime = time.Duration(sharedMaxAge) * time.Second
+	case maxAge >= 0:
+		lifetime = time.Duration(maxAge) * time.Second
+	default:
+		expires, err := http.ParseTime(header.Get("Expires"))
+		date, derr := http.ParseTime(header.Get("Date"))
+		if err == nil && derr == nil && expires.After(date) {
+			lifetime = expires.Sub(date)
+		}
+	}
+
+	if lifetime <= 0 && header.Get("Etag") == "" && header.Get("Last-Modified") == "" {
+		return 0, false
+	}
+
+	return lifetime, true
+}
+
+// parseSeconds parses a Cache-Control delta-seconds value, returning -1
+// if it is invalid.
+func parseSeconds(value string) int {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return -1
+	}
+	return seconds
+}
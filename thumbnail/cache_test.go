@@ -0,0 +1,66 @@
+package thumbnail
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	for _, test := range []struct {
+		header   http.Header
+		lifetime time.Duration
+		ok       bool
+	}{
+		{http.Header{}, 0, false},
+		{http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{http.Header{"Cache-Control": {`public, max-age="60"`}}, time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=60", "no-cache"}, "Etag": {`"x"`}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=60", "no-cache"}}, 0, false},
+		{http.Header{"Cache-Control": {"max-age=60, private"}}, 0, false},
+		{http.Header{"Cache-Control": {"No-Store"}, "Etag": {`"x"`}}, 0, false},
+		{http.Header{"Cache-Control": {"max-age=bogus"}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, 0, true},
+		{http.Header{"Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Expires": {"Mon, 02 Jan 2006 16:04:05 GMT"}}, time.Hour, true},
+		{http.Header{"Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Expires": {"0"}}, 0, false},
+	} {
+		lifetime, ok := cacheLifetime(test.header)
+		assert.Equal(t, test.lifetime, lifetime, "%v", test.header)
+		assert.Equal(t, test.ok, ok, "%v", test.header)
+	}
+}
+
+func TestCacheEntry(t *testing.T) {
+	now := time.Now()
+	header := http.Header{"Cache-Control": {"max-age=60"}, "Age": {"10"}, "Etag": {`"x"`}, "Server": {"origin"}}
+
+	e := newCacheEntry(header, []byte("thumb"), now)
+	assert.True(t, e.fresh(now.Add(49*time.Second)))
+	assert.False(t, e.fresh(now.Add(50*time.Second)))
+	assert.Equal(t, "15", e.age(now.Add(5*time.Second)))
+	assert.Equal(t, "", e.Header.Get("Server"))
+
+	// Survive a round trip through a Cache.
+	b, err := e.encode()
+	assert.Nil(t, err)
+	d, err := decodeCacheEntry(b)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Thumb, d.Thumb)
+	assert.Equal(t, e.Header, d.Header)
+	assert.True(t, e.Expires.Equal(d.Expires))
+
+	// Revalidate with our own validators, not the client's.
+	r := d.revalidate(http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Accept": {"image/*"}})
+	assert.Equal(t, http.Header{"If-None-Match": {`"x"`}, "Accept": {"image/*"}}, r)
+
+	// A 304 response extends the lifetime.
+	assert.True(t, d.update(http.Header{"Cache-Control": {"max-age=120"}}, now))
+	assert.True(t, d.fresh(now.Add(119*time.Second)))
+	assert.Equal(t, "max-age=120", d.Header.Get("Cache-Control"))
+	assert.Equal(t, `"x"`, d.Header.Get("Etag"))
+
+	// And can make it uncacheable.
+	assert.False(t, d.update(http.Header{"Cache-Control": {"no-store"}}, now))
+}
@@ -0,0 +1,85 @@
+package thumbnail
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls with the same key into one
+// execution, whose result is shared by every caller.  The shared call
+// isn't tied to any one caller's Context: it keeps running while any
+// caller is still waiting for it, and is canceled once none are.  The
+// zero value is ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	calls   map[string]*flightCall
+	running sync.WaitGroup
+}
+
+type flightCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	value   interface{}
+	err     error
+}
+
+// Do calls fn once for all concurrent callers with the same key, and
+// returns its result, or ErrAborted if ctx is done first.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		cctx, cancel := context.WithCancel(context.Background())
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		g.running.Add(1)
+		go g.run(cctx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	c.waiters--
+	if c.waiters == 0 {
+		// Nobody else wants it; stop the call, and let the next caller
+		// with this key start a new one.
+		c.cancel()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+	}
+	g.mu.Unlock()
+
+	return nil, ErrAborted
+}
+
+// Wait waits for every call to finish, including those that all callers
+// have stopped waiting for.  Do must not be called at the same time.
+func (g *flightGroup) Wait() {
+	g.running.Wait()
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, c *flightCall, fn func(context.Context) (interface{}, error)) {
+	defer g.running.Done()
+
+	c.value, c.err = fn(ctx)
+
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	c.cancel()
+	close(c.done)
+}
@@ -0,0 +1,144 @@
+package thumbnail
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightShared(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "done", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.Do(context.Background(), "key", fn)
+			assert.Nil(t, err)
+			assert.Equal(t, "done", v)
+		}()
+	}
+
+	// Wait for every caller to join the call before finishing it.
+	for !waiting(&g, "key", 10) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// A later call runs again.
+	v, err := g.Do(context.Background(), "key", fn)
+	assert.Nil(t, err)
+	assert.Equal(t, "done", v)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestFlightCancel(t *testing.T) {
+	var g flightGroup
+
+	// One caller giving up doesn't cancel the call for the other.
+	fn, release, canceled := blockingCall()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan interface{})
+	go func() {
+		v, _ := g.Do(context.Background(), "key", fn)
+		result <- v
+	}()
+	go func() {
+		_, err := g.Do(ctx, "key", fn)
+		result <- err
+	}()
+	for !waiting(&g, "key", 2) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, ErrAborted, <-result)
+	close(release)
+	assert.Equal(t, "done", <-result)
+
+	// But the last caller giving up does.
+	fn, _, canceled = blockingCall()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := g.Do(ctx, "key", fn)
+		result <- err
+	}()
+	for !waiting(&g, "key", 1) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, ErrAborted, <-result)
+	<-canceled
+}
+
+func TestFlightWait(t *testing.T) {
+	var g flightGroup
+
+	// Wait outlasts a call that its caller abandoned.
+	release := make(chan struct{})
+	slow := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		<-release
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := g.Do(ctx, "key", slow)
+	assert.Equal(t, ErrAborted, err)
+
+	waited := make(chan struct{})
+	go func() {
+		g.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a call was running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-waited
+
+	// And returns at once when nothing is running.
+	g.Wait()
+}
+
+// blockingCall returns a function for flightGroup.Do that finishes when
+// release is closed, or closes canceled if its Context is done first.
+func blockingCall() (fn func(context.Context) (interface{}, error), release, canceled chan struct{}) {
+	release = make(chan struct{})
+	canceled = make(chan struct{})
+	fn = func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			close(canceled)
+			return nil, ctx.Err()
+		case <-release:
+			return "done", nil
+		}
+	}
+	return fn, release, canceled
+}
+
+// waiting returns true if n callers are waiting for key.
+func waiting(g *flightGroup, key string, n int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	c, ok := g.calls[key]
+	return ok && c.waiters == n
+}
@@ -0,0 +1,50 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrCheckRunning is returned by Check while an earlier check is still
+// waiting for the Pool.
+var ErrCheckRunning = errors.New("earlier check still running")
+
+// checkImage is a 2x2 orange PNG, run through the Pool by Check.
+var checkImage = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x02,
+	0x08, 0x02, 0x00, 0x00, 0x00, 0xfd, 0xd4, 0x9a, 0x73, 0x00, 0x00, 0x00,
+	0x10, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x63, 0xf8, 0xdf, 0xc0, 0x00,
+	0x44, 0x0c, 0x10, 0x0a, 0x00, 0x2d, 0xee, 0x05, 0xfd, 0x63, 0x3e, 0xc1,
+	0x0b, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+// Check runs a tiny image through p's Pool, returning an error if that
+// fails or doesn't finish before ctx is done, as when every worker is
+// stuck.  Only one check waits for the Pool at a time.
+func (p *Proxy) Check(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&p.checking, 0, 1) {
+		return ErrCheckRunning
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer atomic.StoreInt32(&p.checking, 0)
+		_, err := p.pool.Thumbnail(ctx, checkImage, Options{Width: 1, Height: 1})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Active returns how many of p's places for original images are in use,
+// and how many there are.
+func (p *Proxy) Active() (int, int) {
+	return cap(p.active) - len(p.active), cap(p.active)
+}
@@ -16,40 +16,123 @@ var (
 	ErrTooSmall = errors.New("image is too small")
 )
 
+// DefaultMaxEnlarge is used when Options.MaxEnlarge is unspecified.
+const DefaultMaxEnlarge = 2.0
+
 const (
 	minDimension = 2             // Avoid off-by-one divide-by-zero errors.
 	maxDimension = (1 << 15) - 2 // Avoid signed int16 overflows.
 )
 
+// CropMode selects which part of an image is kept when cropping.
+type CropMode int
+
+// Various CropMode values.
+const (
+	// CropTop centres horizontally and keeps the upper part of the image
+	// vertically, where faces usually are.
+	CropTop CropMode = iota
+	// CropCentre keeps the middle of the image.
+	CropCentre
+	// CropEntropy keeps the part of the image with the most detail.
+	CropEntropy
+	// CropAttention keeps the part of the image most likely to draw the
+	// eye, judging by skin tones, saturated colours, and edges.
+	CropAttention
+	// CropFocus centres the crop on Options.Focus, as near as the
+	// image's edges allow.
+	CropFocus
+)
+
+// FocalPoint is a position within an image, as fractions (0-1) of its
+// displayed width and height from its top left corner.
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+// Color is an sRGB color with alpha, each from 0 to 255.
+type Color struct {
+	R uint8
+	G uint8
+	B uint8
+	A uint8
+}
+
 // Options specifies how a Thumbnail operation should modify an image.
 type Options struct {
 	// Width and Height are the optional maximum sizes of output image,
 	// in pixels.  If Crop is false, the original aspect ratio is
-	// preserved and the more restrictive of Width or Height are used.
+	// preserved and the more restrictive of Width or Height are used, and
+	// if only one is given, the other follows from the aspect ratio.
 	Width  int
 	Height int
 	// Crop enables crop mode, where exact supplied Width:Height aspect
 	// ratio is preserved and excess pixels are trimmed from the sides.
 	Crop bool
+	// CropMode selects which part of the image Crop keeps.  Animations
+	// use CropCentre in place of CropEntropy or CropAttention.
+	CropMode CropMode
+	// Focus is the subject of the image, used by CropFocus.
+	Focus FocalPoint
+	// Pad enables pad mode, where the image is scaled to fit within
+	// Width and Height like the default, then centred and padded with
+	// Background to exactly that size.
+	Pad bool
+	// Background is the color of padding.  It is only transparent if
+	// the image already has transparency, or Save.Format is one that
+	// supports it.  Otherwise, its alpha is ignored, and a fully
+	// transparent Background, such as the default, becomes white.
+	Background Color
+	// Enlarge allows scaling an image up to fill Width and Height,
+	// rather than stopping at its original size.
+	Enlarge bool
+	// MaxEnlarge limits how many times wider and taller Enlarge may
+	// make an image (0=DefaultMaxEnlarge).
+	MaxEnlarge float64
 	// Sharpen runs a mild sharpening pass on downsampled images.
 	Sharpen bool
 	// BlurSigma performs a gaussian blur with specified sigma.
 	BlurSigma float64
 	// MaxBufferPixels specifies how large of an intermediate image
 	// buffer to allow, in pixels. RAM usage will be a few bytes per pixel.
+	// For an animation, this counts the pixels of every frame.
 	MaxBufferPixels int
+	// Animated keeps every frame of an animated GIF or WebP, rather than
+	// just the first, and saves the result as an animated GIF or WebP.
+	Animated bool
+	// MaxFrames limits how many frames an animated image may have (0=no limit).
+	MaxFrames int
 	// MaxQueueDuration limits the amount of time spent in a queue before processing starts.
 	MaxQueueDuration time.Duration
+	// Priority and Tenant decide when a Pool runs this operation: after
+	// any waiting operations of a more urgent Priority, and taking turns
+	// with other tenants' operations of the same Priority.
+	Priority Priority
+	Tenant   string
 	// MaxProcessingDuration limits the amount of time processing an
-	// image, after which it is assumed the operation has crashed and
-	// the server aborts, killing all outstanding requests.
+	// image, after which the operation is aborted and returns
+	// ErrProcessingTimeout.
 	MaxProcessingDuration time.Duration
+	// AbortGracePeriod is how long an operation aborted for taking
+	// longer than MaxProcessingDuration has to stop.  If it's still
+	// running after that, it is logged as stuck
+	// (0=DefaultAbortGracePeriod).
+	AbortGracePeriod time.Duration
+	// MaxStuck is how many operations may be found stuck within
+	// StuckWindow before VIPS is assumed to be broken, and the process
+	// exits, killing all outstanding requests (0=DefaultMaxStuck).
+	MaxStuck int
+	// StuckWindow is how long a stuck operation counts towards MaxStuck
+	// (0=DefaultStuckWindow).
+	StuckWindow time.Duration
 	// Save specifies the format.SaveOptions to use when compressing the modified image.
 	Save format.SaveOptions
 	// Optional input formats
 	AllowPdf  bool
 	AllowSvg  bool
 	AllowTiff bool
+	AllowHeif bool // Both HEIC and AVIF
 }
 
 // Check verifies Options against Metadata and returns a modified
@@ -67,12 +150,20 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 		return Options{}, ErrTooBig
 	}
 
-	// If output width or height are not set, use original.
+	// If only one of output width or height is set, derive the other
+	// from the original aspect ratio, except when cropping.  Otherwise
+	// use original.
 	if o.Width == 0 {
 		o.Width = m.Width
+		if o.Height > 0 && !o.Crop {
+			o.Width = aspectDimension(m.Width, m.Height, o.Height)
+		}
 	}
 	if o.Height == 0 {
 		o.Height = m.Height
+		if o.Width > 0 && !o.Crop {
+			o.Height = aspectDimension(m.Height, m.Width, o.Width)
+		}
 	}
 	// Security: Verify requested width and height.
 	if o.Width < 1 || o.Height < 1 {
@@ -81,20 +172,37 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 	if o.Width > maxDimension || o.Height > maxDimension {
 		return Options{}, ErrTooBig
 	}
-	// If requested crop width or height are larger than original, scale
-	// request down to fit within original dimensions.
-	if o.Crop && (o.Width > m.Width || o.Height > m.Height) {
-		o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, m.Width, m.Height, true)
+	if !(o.MaxEnlarge == 0 || (o.MaxEnlarge >= 1 && o.MaxEnlarge <= maxDimension)) {
+		return Options{}, ErrBadOption
+	}
+	// If requested crop width or height are larger than original, or
+	// the allowed enlargement of it, scale request down to fit within
+	// those dimensions.
+	if mw, mh := o.maxSize(m); o.Crop && (o.Width > mw || o.Height > mh) {
+		o.Width, o.Height, _ = scaleAspect(o.Width, o.Height, mw, mh, true)
 	}
 
 	// If set, limit allocated pixels to MaxBufferPixels.  Assume JPEG,
 	// Webp, Pdf, and Svg decoders can pre-scale to 1/8 original width and
-	// height.
+	// height, except for animations, where every frame is loaded at full
+	// size.
 	scale := 1
-	if m.Format == format.Jpeg || m.Format == format.Webp || m.Format == format.Pdf || m.Format == format.Svg {
+	frames := 1
+	if o.animated(m) {
+		if o.MaxFrames > 0 && m.Pages > o.MaxFrames {
+			return Options{}, ErrTooBig
+		}
+		frames = m.Pages
+	} else if m.Format == format.Jpeg || m.Format == format.Webp || m.Format == format.Pdf || m.Format == format.Svg {
 		scale = 8
 	}
-	if o.MaxBufferPixels > 0 && m.Width*m.Height > o.MaxBufferPixels*scale*scale {
+	if o.MaxBufferPixels > 0 && m.Width*m.Height*frames > o.MaxBufferPixels*scale*scale {
+		return Options{}, ErrTooBig
+	}
+	if o.Pad && o.MaxBufferPixels > 0 && o.Width*o.Height*frames > o.MaxBufferPixels {
+		return Options{}, ErrTooBig
+	}
+	if iw, ih, _ := o.scaledSize(m); o.Enlarge && o.MaxBufferPixels > 0 && iw*ih*frames > o.MaxBufferPixels {
 		return Options{}, ErrTooBig
 	}
 
@@ -102,9 +210,56 @@ func (o Options) Check(m format.Metadata) (Options, error) {
 		return Options{}, ErrBadOption
 	}
 
+	if o.Crop && o.Pad {
+		return Options{}, ErrBadOption
+	}
+
+	if o.CropMode < CropTop || o.CropMode > CropFocus {
+		return Options{}, ErrBadOption
+	}
+
+	if !(o.Focus.X >= 0.0 && o.Focus.X <= 1.0 && o.Focus.Y >= 0.0 && o.Focus.Y <= 1.0) {
+		return Options{}, ErrBadOption
+	}
+
 	return o, nil
 }
 
+// maxSize returns the largest that an image described by m may be
+// scaled to.
+func (o Options) maxSize(m format.Metadata) (int, int) {
+	if !o.Enlarge {
+		return m.Width, m.Height
+	}
+
+	factor := o.MaxEnlarge
+	if factor == 0 {
+		factor = DefaultMaxEnlarge
+	}
+
+	return int(float64(m.Width) * factor), int(float64(m.Height) * factor)
+}
+
+// scaledSize returns the size that an image described by m is scaled to,
+// before it is cropped or padded, and whether the width is exact.
+func (o Options) scaledSize(m format.Metadata) (int, int, bool) {
+	// For crop, this is the intermediate size the original image would
+	// have to be scaled to be cropped to requested size.
+	iw, ih, trustWidth := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop)
+
+	// Don't scale past the original size, or allowed enlargement.
+	if mw, mh := o.maxSize(m); iw > mw || ih > mh {
+		iw, ih, trustWidth = scaleAspect(m.Width, m.Height, mw, mh, true)
+	}
+
+	return iw, ih, trustWidth
+}
+
+// animated returns true if every frame of an image should be kept.
+func (o Options) animated(m format.Metadata) bool {
+	return o.Animated && m.Pages > 1 && (m.Format == format.Gif || m.Format == format.Webp)
+}
+
 func (o Options) allowedFormat(m format.Metadata) bool {
 	switch m.Format {
 	case format.Unknown:
@@ -122,6 +277,10 @@ func (o Options) allowedFormat(m format.Metadata) bool {
 		if !o.AllowTiff {
 			return false
 		}
+	case format.Avif, format.Heif:
+		if !o.AllowHeif {
+			return false
+		}
 	default:
 	}
 
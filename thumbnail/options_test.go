@@ -1,6 +1,7 @@
 package thumbnail
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,6 +32,27 @@ func TestOptionsValidation(t *testing.T) {
 	_, err = Options{BlurSigma: -1}.Check(m)
 	assert.Equal(t, err, ErrBadOption)
 
+	_, err = Options{Enlarge: true, MaxEnlarge: 0.5}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Enlarge: true, MaxEnlarge: math.Inf(1)}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Crop: true, Pad: true}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Width: 2000, Height: 2000, Pad: true, MaxBufferPixels: 1000000}.Check(m)
+	assert.Equal(t, err, ErrTooBig)
+
+	_, err = Options{CropMode: CropFocus + 1}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Focus: FocalPoint{X: 1.5, Y: 0.5}}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
+	_, err = Options{Focus: FocalPoint{X: 0.5, Y: -0.5}}.Check(m)
+	assert.Equal(t, err, ErrBadOption)
+
 	_, err = Options{Width: -1}.Check(m)
 	assert.Equal(t, err, ErrTooSmall)
 
@@ -53,9 +75,41 @@ func TestOptionsCrop(t *testing.T) {
 	assert.Equal(t, r.Width, 240)
 	assert.Equal(t, r.Height, 480)
 
+	// Unless enlarging, up to twice the original size.
+	r, err = Options{Width: 2000, Height: 1000, Crop: true, Enlarge: true}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 1280)
+	assert.Equal(t, r.Height, 640)
+
 	// Without the Crop flag, we don't adjust dimensions.
 	r, err = Options{Width: 400, Height: 800, Crop: false}.Check(m)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, r.Width, 400)
 	assert.Equal(t, r.Height, 800)
 }
+
+func TestOptionsOneDimension(t *testing.T) {
+	m := format.Metadata{Width: 640, Height: 480, Format: format.Jpeg}
+
+	// A missing width or height follows the aspect ratio.
+	r, err := Options{Width: 320}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 320)
+	assert.Equal(t, r.Height, 240)
+
+	r, err = Options{Height: 100, Enlarge: true}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 134)
+	assert.Equal(t, r.Height, 100)
+
+	r, err = Options{Height: 960, Enlarge: true}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 1280)
+	assert.Equal(t, r.Height, 960)
+
+	// When cropping, it is the original size instead.
+	r, err = Options{Height: 100, Crop: true}.Check(m)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Width, 640)
+	assert.Equal(t, r.Height, 100)
+}
@@ -0,0 +1,125 @@
+package thumbnail
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CacheStats counts the activity of a cache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Bytes     int64
+}
+
+// OriginalCache keeps recently fetched original images in memory, up to
+// a total size in bytes, so that a Proxy asked for several sizes of the
+// same image only fetches it once.  Originals are kept for as long as
+// their Cache-Control or Expires headers allow.  Must be created with
+// NewOriginalCache.
+type OriginalCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	stats   CacheStats
+	lru     *list.List // Of *original, most recently used first.
+	entries map[string]*list.Element
+}
+
+// original is an image fetched from upstream.
+type original struct {
+	url     string
+	blob    []byte
+	header  http.Header
+	status  int
+	stored  time.Time // When received, less its Age.
+	expires time.Time
+}
+
+// NewOriginalCache returns an OriginalCache that holds at most maxBytes
+// of original images.
+func NewOriginalCache(maxBytes int64) *OriginalCache {
+	return &OriginalCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Stats returns the hits, misses, and evictions so far, and the current
+// size of the cache.
+func (c *OriginalCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// get returns the unexpired original fetched from url, if any, with its
+// Age header brought up to date.
+func (c *OriginalCache) get(url string, now time.Time) (*original, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[url]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	o := el.Value.(*original)
+	if !now.Before(o.expires) {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+
+	aged := *o
+	aged.header = o.header.Clone()
+	aged.header.Set("Age", strconv.Itoa(int(now.Sub(o.stored)/time.Second)))
+
+	return &aged, true
+}
+
+// add stores o, if its headers allow it to be kept for a while, and
+// evicts the least recently used originals to stay within the size limit.
+func (c *OriginalCache) add(o *original, now time.Time) {
+	lifetime, ok := cacheLifetime(o.header)
+	if !ok || lifetime <= 0 || o.status != http.StatusOK || int64(len(o.blob)) > c.maxBytes {
+		return
+	}
+
+	age, _ := strconv.Atoi(o.header.Get("Age"))
+	o.stored = now.Add(-time.Duration(age) * time.Second)
+	o.expires = o.stored.Add(lifetime)
+	if !now.Before(o.expires) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[o.url]; ok {
+		c.remove(el)
+	}
+	c.entries[o.url] = c.lru.PushFront(o)
+	c.stats.Bytes += int64(len(o.blob))
+
+	for c.stats.Bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove forgets el.  Must hold mu.
+func (c *OriginalCache) remove(el *list.Element) {
+	o := c.lru.Remove(el).(*original)
+	delete(c.entries, o.url)
+	c.stats.Bytes -= int64(len(o.blob))
+}
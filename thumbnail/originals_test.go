@@ -0,0 +1,54 @@
+package thumbnail
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginalCache(t *testing.T) {
+	c := NewOriginalCache(10)
+	now := time.Now()
+	fresh := http.Header{"Cache-Control": {"max-age=60"}}
+
+	_, ok := c.get("a", now)
+	assert.False(t, ok)
+
+	c.add(&original{url: "a", blob: []byte("apple"), header: fresh, status: http.StatusOK}, now)
+	o, ok := c.get("a", now.Add(5*time.Second))
+	if assert.True(t, ok) {
+		assert.Equal(t, "apple", string(o.blob))
+		assert.Equal(t, "5", o.header.Get("Age"))
+	}
+
+	// Expire after max-age, less any Age from upstream.
+	c.add(&original{url: "b", blob: []byte("bean"), header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"30"}}, status: http.StatusOK}, now)
+	_, ok = c.get("b", now.Add(29*time.Second))
+	assert.True(t, ok)
+	_, ok = c.get("b", now.Add(30*time.Second))
+	assert.False(t, ok)
+
+	// Don't keep errors, uncacheable responses, or ones that don't stay
+	// fresh for a while.
+	c.add(&original{url: "c", blob: []byte("c"), header: fresh, status: http.StatusNotFound}, now)
+	c.add(&original{url: "d", blob: []byte("d"), header: http.Header{"Cache-Control": {"no-store"}}, status: http.StatusOK}, now)
+	c.add(&original{url: "e", blob: []byte("e"), header: http.Header{"Etag": {`"e"`}}, status: http.StatusOK}, now)
+	for _, url := range []string{"c", "d", "e"} {
+		_, ok = c.get(url, now)
+		assert.False(t, ok, url)
+	}
+
+	// Evict the least recently used to stay within the size limit.
+	c.add(&original{url: "f", blob: []byte("fig"), header: fresh, status: http.StatusOK}, now)
+	_, ok = c.get("a", now)
+	assert.True(t, ok)
+	c.add(&original{url: "g", blob: []byte("grape"), header: fresh, status: http.StatusOK}, now)
+	_, ok = c.get("f", now)
+	assert.False(t, ok)
+	_, ok = c.get("a", now)
+	assert.True(t, ok)
+
+	assert.Equal(t, CacheStats{Hits: 4, Misses: 6, Evictions: 1, Bytes: 10}, c.Stats())
+}
@@ -9,22 +9,26 @@ import (
 	"github.com/die-net/fotomat/v2/vips"
 )
 
-// ErrAborted means the operation wasn't executed because the
-// Request.Aborted channel was closed by the caller.
+// ErrAborted means the operation wasn't executed, or was stopped partway,
+// because its Context was done.
 var ErrAborted = errors.New("thumbnail request aborted")
 
 // Pool represents a Thumbnail worker pool. VIPS keeps thread-local caches,
 // which we retain control over through a combination of a pool of worker
 // goroutines and using runtime.LockOSThread() within those workers.
+// Requests sent to RequestCh wait in a queue for each Priority, where
+// more urgent ones always go first, and tenants share the workers
+// fairly.
 type Pool struct {
 	RequestCh chan *Request
+	queue     *scheduler
 	wg        sync.WaitGroup
 }
 
 // NewPool creates a Thumbnail worker pool with a given number of worker
 // threads and queue length.
 func NewPool(workers, queueLen int) *Pool {
-	p := &Pool{RequestCh: make(chan *Request, queueLen)}
+	p := &Pool{RequestCh: make(chan *Request, queueLen), queue: newScheduler()}
 
 	if workers <= 0 {
 		workers = runtime.NumCPU()
@@ -32,6 +36,7 @@ func NewPool(workers, queueLen int) *Pool {
 
 	p.wg.Add(workers)
 
+	go p.dispatch()
 	for i := 0; i < workers; i++ {
 		go p.worker()
 	}
@@ -40,6 +45,7 @@ func NewPool(workers, queueLen int) *Pool {
 }
 
 // Request to be sent to Pool.RequestCh to queue a Thumbnail operation.
+// It is scheduled by its Options.Priority and Options.Tenant.
 type Request struct {
 	Blob       []byte
 	Options    Options
@@ -53,9 +59,10 @@ type Response struct {
 	Error error
 }
 
-// Thumbnail is a blocking wrapper that executes thumbnail.Thumbnail
-// requests in a pool of worker threads.  Work is skipped if aborted is
-// closed while the request is queued.
+// Thumbnail is a blocking wrapper that executes thumbnail.ThumbnailContext
+// requests in a pool of worker threads.  Work is skipped if ctx is done
+// while the request is queued, and stopped early if it is done while the
+// request is being processed.
 func (p *Pool) Thumbnail(ctx context.Context, blob []byte, options Options) ([]byte, error) {
 	rc := make(chan *Response)
 
@@ -68,21 +75,37 @@ func (p *Pool) Thumbnail(ctx context.Context, blob []byte, options Options) ([]b
 	return s.Blob, s.Error
 }
 
+// SetTenantWeight sets the share of workers that tenant gets, relative
+// to other tenants with requests of the same Priority waiting (default 1).
+func (p *Pool) SetTenantWeight(tenant string, weight int) {
+	p.queue.setWeight(tenant, weight)
+}
+
+// QueueDepth returns how many requests of priority are waiting for a
+// worker.
+func (p *Pool) QueueDepth(priority Priority) int {
+	return p.queue.depth(priority)
+}
+
+// dispatch moves requests from RequestCh to the queue.
+func (p *Pool) dispatch() {
+	for q := range p.RequestCh {
+		p.queue.push(q)
+	}
+	p.queue.close()
+}
+
 func (p *Pool) worker() {
 	runtime.LockOSThread()
 
 	for {
-		q := <-p.RequestCh
+		q := p.queue.pop()
 		if q == nil {
 			break
 		}
 
 		s := &Response{}
-		if hasAborted(q.Context) {
-			s.Error = ErrAborted
-		} else {
-			s.Blob, s.Error = Thumbnail(q.Blob, q.Options)
-		}
+		s.Blob, s.Error = ThumbnailContext(q.Context, q.Blob, q.Options)
 
 		q.ResponseCh <- s
 	}
@@ -1,6 +1,7 @@
 package thumbnail
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -8,6 +9,8 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/die-net/fotomat/v2/format"
@@ -22,44 +25,166 @@ const (
 	DefaultUserAgent = "Fotomat (http://fotomat.org)"
 )
 
+// sniffLength is how much of an original image is read to check its
+// format before reading the rest.
+const sniffLength = 1024
+
+// maxCacheWrites limits how many thumbnails may be waiting to be written
+// to Cache.  Any more are dropped rather than using more memory.
+const maxCacheWrites = 64
+
+// ErrOriginalTooBig is returned when an original image is larger than
+// Proxy.MaxOriginalBytes.
+var ErrOriginalTooBig = errors.New("original image is too large")
+
+// StatusError can be returned by a Proxy's DirectorErr to refuse a request
+// with a specific HTTP status code.  Message is returned to the client, or
+// the standard status text if it is empty.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.Status)
+}
+
+// Origin fetches original images for a Proxy, given a GET request whose
+// URL was set by the Proxy's Director.  An *http.Client is an Origin.
+type Origin interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
 // Proxy represents an HTTP proxy that can optionally run its contents
-// through Thumbnail. Must be created with NewProxy.
+// through Thumbnail. Must be created with NewProxy or NewProxyErr.
 type Proxy struct {
-	Director  func(*http.Request) (Options, int)
+	// Director parses a request, rewrites its URL to point at the
+	// original image, and returns the Options to thumbnail it with, or a
+	// non-zero status code to refuse the request with.
+	Director func(*http.Request) (Options, int)
+	// DirectorErr, if set, is used instead of Director, and can say why
+	// it refused a request.  Any error refuses the request: a
+	// *StatusError with its status code, and anything else as a
+	// StatusBadRequest with the error's text.
+	DirectorErr func(*http.Request) (Options, error)
+	// Origin fetches the original images.  If it is nil, Client does.
+	Origin Origin
+	// Client fetches the original images if Origin is nil.
+	//
+	// Deprecated: Set Origin instead, which an *http.Client can be, or
+	// create the Proxy with NewProxyErr.
 	Client    *http.Client
 	Accept    string
 	Server    string
 	UserAgent string
-	pool      *Pool
-	active    chan bool
+	// NegotiateFormat allows WebP or AVIF output when the request's
+	// Accept header lists them and Director didn't pick an output format.
+	NegotiateFormat bool
+	// LosslessWebp replaces Options.Save.Lossless when NegotiateFormat
+	// allows WebP, as lossless WebP is usually much larger than lossy.
+	LosslessWebp bool
+	// Cache, if set, keeps thumbnails to answer repeated requests
+	// without fetching or processing the original image again.
+	Cache Cache
+	// Originals, if set, keeps recently fetched original images, and
+	// concurrent requests for the same original share one fetch.
+	Originals *OriginalCache
+	// MaxOriginalBytes limits the size of an original image (0=no limit).
+	MaxOriginalBytes int64
+	// ClientHints lists the client hint headers that Director may use.
+	// Responses ask for them with Accept-CH, and list them in Vary.
+	ClientHints []string
+	// Retries is how many times a fetch is retried if the origin can't
+	// be reached or answers 502, 503, or 504.
+	Retries int
+	// RetryBackoff is roughly the delay before the first retry, which
+	// doubles for each one after.
+	RetryBackoff time.Duration
+	// MaxOriginFetches limits how many images may be fetched from each
+	// origin at once (0=no limit).  Requests wait for this before
+	// taking one of maxActive's places, so a slow origin can't hold them
+	// all.
+	MaxOriginFetches int
+	// BreakerFailures is how many consecutive failed fetches from an
+	// origin open its circuit breaker, refusing its requests with
+	// ErrOriginUnavailable for BreakerCooldown (0=never).
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	pool            *Pool
+	active          chan bool
+	batch           chan bool
+	fetches         flightGroup
+	requests        flightGroup
+	upstreams       upstreams
+	checking        int32
+	cacheWrites     chan bool
+	caching         sync.WaitGroup
 }
 
 // NewProxy creates a Proxy object, with a given Director, Pool, upper limit
-// on images held in RAM, and http.Client.
+// on images held in RAM, and http.Client, which it sets as Client.
+// Requests that aren't PriorityInteractive may only hold half of those
+// images.  To fetch from another Origin, such as an s3.Origin, set Origin
+// on the returned Proxy, or use NewProxyErr.
 func NewProxy(director func(*http.Request) (Options, int), pool *Pool, maxActive int, client *http.Client) *Proxy {
-	if director == nil || pool == nil || client == nil || maxActive <= 0 {
+	if director == nil || client == nil {
+		return nil
+	}
+
+	p := newProxy(pool, maxActive)
+	if p != nil {
+		p.Director = director
+		p.Client = client
+	}
+	return p
+}
+
+// NewProxyErr is like NewProxy, but with a DirectorErr instead of a
+// Director, and an Origin, such as an http.Client, instead of a Client.
+func NewProxyErr(director func(*http.Request) (Options, error), pool *Pool, maxActive int, origin Origin) *Proxy {
+	if director == nil || origin == nil {
+		return nil
+	}
+
+	p := newProxy(pool, maxActive)
+	if p != nil {
+		p.DirectorErr = director
+		p.Origin = origin
+	}
+	return p
+}
+
+func newProxy(pool *Pool, maxActive int) *Proxy {
+	if pool == nil || maxActive <= 0 {
 		return nil
 	}
 
 	p := &Proxy{
-		Director:  director,
-		Client:    client,
-		Accept:    DefaultAccept,
-		Server:    DefaultServer,
-		UserAgent: DefaultUserAgent,
-		pool:      pool,
-		active:    make(chan bool, maxActive),
+		Accept:      DefaultAccept,
+		Server:      DefaultServer,
+		UserAgent:   DefaultUserAgent,
+		pool:        pool,
+		active:      make(chan bool, maxActive),
+		batch:       make(chan bool, (maxActive+1)/2),
+		cacheWrites: make(chan bool, maxCacheWrites),
 	}
 
 	for i := 0; i < maxActive; i++ {
 		p.active <- true
 	}
+	// Leave at least half of the places for interactive requests.
+	for i := 0; i < cap(p.batch); i++ {
+		p.batch <- true
+	}
 
 	return p
 }
 
-// ServeHTTP serves an HTTP request for a given Proxy, using Director to
-// parse the request, fetching an image, calling pool.Thumbnail on it, and
+// ServeHTTP serves an HTTP request for a given Proxy, using DirectorErr or
+// Director to parse the request, fetching an image, calling pool.Thumbnail on it, and
 // returning the result.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 	ctx := or.Context()
@@ -67,61 +192,255 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, or *http.Request) {
 	w.Header().Set("Server", p.Server)
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
+	if len(p.ClientHints) > 0 {
+		hints := strings.Join(p.ClientHints, ", ")
+		w.Header().Set("Accept-CH", hints)
+		w.Header().Add("Vary", hints)
+	}
 
 	if or.Method != "GET" && or.Method != "HEAD" {
 		proxyError(w, nil, http.StatusMethodNotAllowed)
 		return
 	}
 
-	options, status := p.Director(or)
-	if status != 0 {
-		http.Error(w, http.StatusText(status), status)
+	options, err := p.direct(or)
+	if err != nil {
+		directorError(w, err)
 		return
 	}
 
+	if p.NegotiateFormat && options.Save.Format == format.Unknown {
+		w.Header().Add("Vary", "Accept")
+		options.Save = negotiateFormat(or.Header.Values("Accept"), options.Save, p.LosslessWebp)
+	}
+
+	// Serve a fresh cached thumbnail without waiting for a turn.
+	key := cacheKey(or.URL.String(), options)
+	var cached *cacheEntry
+	if p.Cache != nil {
+		cached = p.cacheGet(key)
+		if cached != nil && cached.fresh(time.Now()) {
+			serveCached(w, or, cached)
+			return
+		}
+	}
+
+	// Identical requests in flight at the same time share one result,
+	// except that an interactive request doesn't wait behind a batch one.
+	flightKey := key + "\n" + options.Priority.String() + "\n" + or.Header.Get("If-None-Match") + "\n" + or.Header.Get("If-Modified-Since")
+	v, err := p.requests.Do(ctx, flightKey, func(ctx context.Context) (interface{}, error) {
+		return p.thumbnail(ctx, or.URL.String(), or.Header, options, key, cached), nil
+	})
+	if err != nil {
+		proxyError(w, err, 0)
+		return
+	}
+	r := v.(*proxyResult)
+
+	switch {
+	case r.err != nil || (r.status != http.StatusOK && r.status != http.StatusNotModified):
+		// Don't copy Cache-Control, etc when returning errors.
+		proxyError(w, r.err, r.status)
+	case r.cached != nil:
+		serveCached(w, or, r.cached)
+	case r.status == http.StatusNotModified:
+		copyHeaders(r.header, w.Header(), []string{"Age", "Cache-Control", "Date", "Etag", "Expires", "Last-Modified"})
+		w.WriteHeader(http.StatusNotModified)
+	default:
+		copyHeaders(r.header, w.Header(), []string{"Age", "Cache-Control", "Date", "Etag", "Expires", "Last-Modified"})
+		writeThumb(w, r.thumb)
+	}
+}
+
+// proxyResult is the outcome of Proxy.thumbnail, shared by every
+// identical request.
+type proxyResult struct {
+	// thumb is the thumbnail, or cached holds it instead.
+	thumb  []byte
+	cached *cacheEntry
+	// header holds the upstream response headers.
+	header http.Header
+	// status is StatusOK, StatusNotModified, or an error status.
+	status int
+	err    error
+}
+
+// thumbnail waits for a turn, fetches the original image at url for a
+// client that sent header, and runs it through Thumbnail with options,
+// using and updating the stale cached thumbnail stored under key, if any.
+func (p *Proxy) thumbnail(ctx context.Context, url string, header http.Header, options Options, key string, cached *cacheEntry) *proxyResult {
 	if options.MaxQueueDuration <= 0 {
 		options.MaxQueueDuration = time.Hour // "Forever" for an http request
 	}
 
-	// Wait for our turn to fetch and hold the original image.
+	// Refuse quickly if the origin has been failing.
+	origin := originOf(url)
+	u := p.upstreams.acquire(origin, p.MaxOriginFetches)
+	defer p.upstreams.release(origin, u)
+	if !p.upstreams.allow(u, time.Now()) {
+		return &proxyResult{err: ErrOriginUnavailable}
+	}
+
+	// Wait for our turn to fetch from this origin, then to fetch and
+	// hold the original image.
 	timeout := time.NewTimer(options.MaxQueueDuration)
 	defer timeout.Stop()
+	if options.Priority != PriorityInteractive {
+		select {
+		case <-ctx.Done():
+			return &proxyResult{err: ErrAborted}
+		case <-timeout.C:
+			return &proxyResult{status: http.StatusGatewayTimeout}
+		case <-p.batch:
+		}
+		defer func() { p.batch <- true }()
+	}
+	if !p.upstreams.wait(ctx, u, timeout.C) {
+		return queueExpired(ctx)
+	}
 	select {
 	case <-ctx.Done():
-		proxyError(w, ErrAborted, 0)
-		return
+		p.upstreams.done(u)
+		return &proxyResult{err: ErrAborted}
 	case <-timeout.C:
-		proxyError(w, nil, http.StatusGatewayTimeout)
-		return
+		p.upstreams.done(u)
+		return &proxyResult{status: http.StatusGatewayTimeout}
 	case <-p.active:
 	}
 	defer func() { p.active <- true }()
 
-	orig, header, status, err := p.get(ctx, or.URL.String(), or.Header)
+	// Check whether a stale cached thumbnail is still current, rather
+	// than the client's copy.
+	reqHeader := header
+	if cached != nil {
+		reqHeader = cached.revalidate(header)
+	}
+
+	orig, respHeader, status, err := p.fetch(ctx, url, reqHeader)
+	p.upstreams.done(u)
 	if err != nil || (status != http.StatusOK && status != http.StatusNotModified) {
-		proxyError(w, err, status)
-		return
+		return &proxyResult{status: status, err: err}
 	}
 
-	if status == http.StatusNotModified || isNotModified(or.Header, header) {
-		copyHeaders(header, w.Header(), []string{"Age", "Cache-Control", "Date", "Etag", "Expires", "Last-Modified"})
-		w.WriteHeader(http.StatusNotModified)
-		return
+	if cached != nil && status == http.StatusNotModified {
+		if cached.update(respHeader, time.Now()) {
+			p.cacheSet(key, cached)
+		}
+		return &proxyResult{cached: cached}
+	}
+
+	if status == http.StatusNotModified || isNotModified(header, respHeader) {
+		return &proxyResult{header: respHeader, status: http.StatusNotModified}
 	}
 
 	thumb, err := p.pool.Thumbnail(ctx, orig, options)
 	if err != nil {
-		// Don't copy Cache-Control, etc when returning errors.
-		proxyError(w, err, 0)
+		return &proxyResult{err: err}
+	}
+
+	if p.Cache != nil {
+		if e := newCacheEntry(respHeader, thumb, time.Now()); e != nil {
+			p.cacheSet(key, e)
+		}
+	}
+
+	return &proxyResult{thumb: thumb, header: respHeader, status: http.StatusOK}
+}
+
+// queueExpired returns the result of a request that stopped waiting for
+// its turn.
+func queueExpired(ctx context.Context) *proxyResult {
+	if ctx.Err() != nil {
+		return &proxyResult{err: ErrAborted}
+	}
+	return &proxyResult{status: http.StatusGatewayTimeout}
+}
+
+func (p *Proxy) cacheGet(key string) *cacheEntry {
+	b, ok := p.Cache.Get(key)
+	if !ok {
+		return nil
+	}
+	e, err := decodeCacheEntry(b)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// cacheSet stores e in Cache in the background, so that responses don't
+// wait for it to be written.
+func (p *Proxy) cacheSet(key string, e *cacheEntry) {
+	select {
+	case p.cacheWrites <- true:
+	default:
+		return // Too many writes are already waiting.
+	}
+
+	p.caching.Add(1)
+	go func() {
+		defer p.caching.Done()
+		defer func() { <-p.cacheWrites }()
+
+		if b, err := e.encode(); err == nil {
+			p.Cache.Set(key, b)
+		}
+	}()
+}
+
+func serveCached(w http.ResponseWriter, or *http.Request, e *cacheEntry) {
+	copyHeaders(e.Header, w.Header(), cachedHeaders)
+	w.Header().Set("Age", e.age(time.Now()))
+
+	if isNotModified(or.Header, e.Header) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	copyHeaders(header, w.Header(), []string{"Age", "Cache-Control", "Date", "Etag", "Expires", "Last-Modified"})
+	writeThumb(w, e.Thumb)
+}
+
+func writeThumb(w http.ResponseWriter, thumb []byte) {
+	// Go's content sniffing doesn't know about AVIF or HEIF.
+	w.Header().Set("Content-Type", format.DetectFormat(thumb).String())
 	w.Header().Set("Content-Length", strconv.Itoa(len(thumb)))
 	_, _ = w.Write(thumb)
 }
 
-func (p *Proxy) get(ctx context.Context, url string, header http.Header) ([]byte, http.Header, int, error) {
+// fetch gets url like get, but through Originals if it is set.  The
+// original is always fetched in full, and conditional requests in header
+// are answered from it.
+func (p *Proxy) fetch(ctx context.Context, url string, header http.Header) ([]byte, http.Header, int, error) {
+	if p.Originals == nil {
+		return p.get(ctx, url, header)
+	}
+
+	o, ok := p.Originals.get(url, time.Now())
+	if !ok {
+		v, err := p.fetches.Do(ctx, url, func(ctx context.Context) (interface{}, error) {
+			orig, header, status, err := p.get(ctx, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			o := &original{url: url, blob: orig, header: header, status: status}
+			p.Originals.add(o, time.Now())
+			return o, nil
+		})
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		o = v.(*original)
+	}
+
+	if o.status == http.StatusOK && isNotModified(header, o.header) {
+		return nil, o.header, http.StatusNotModified, nil
+	}
+
+	return o.blob, o.header, o.status, nil
+}
+
+// getOnce makes a single attempt to fetch url from Origin, or Client.
+func (p *Proxy) getOnce(ctx context.Context, url string, header http.Header) ([]byte, http.Header, int, error) {
 	r, err := http.NewRequest("GET", url, http.NoBody)
 	if err != nil {
 		return nil, nil, 0, err
@@ -134,19 +453,82 @@ func (p *Proxy) get(ctx context.Context, url string, header http.Header) ([]byte
 	r.Header.Set("User-Agent", p.UserAgent)
 	copyHeaders(header, r.Header, []string{"Cache-Control", "If-Modified-Since", "If-None-Match"})
 
-	resp, err := p.Client.Do(r)
+	origin := p.Origin
+	if origin == nil {
+		origin = p.Client
+	}
+	resp, err := origin.Do(r)
 	if err != nil {
 		return nil, nil, 0, err
 	}
 
-	orig, err := io.ReadAll(resp.Body)
-	_ = resp.Body.Close()
+	defer resp.Body.Close()
+
+	// Only a successful response's body is used.
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.Header, resp.StatusCode, nil
+	}
 
-	return orig, resp.Header, resp.StatusCode, err
+	orig, err := p.readOriginal(resp)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return orig, resp.Header, resp.StatusCode, nil
 }
 
-// Close shuts down a Proxy.
+// readOriginal reads an original image from resp.  It stops as soon as
+// the image is found to be larger than MaxOriginalBytes, returning
+// ErrOriginalTooBig, or to not start like an image format, returning
+// format.ErrUnknownFormat.
+func (p *Proxy) readOriginal(resp *http.Response) ([]byte, error) {
+	limit := p.MaxOriginalBytes
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, ErrOriginalTooBig
+	}
+
+	var buf bytes.Buffer
+	if limit > 0 && resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength))
+	}
+
+	n, err := io.CopyN(&buf, resp.Body, sniffLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if format.DetectFormat(buf.Bytes()) == format.Unknown {
+		return nil, format.ErrUnknownFormat
+	}
+	if limit > 0 && n > limit {
+		return nil, ErrOriginalTooBig
+	}
+	if n < sniffLength {
+		return buf.Bytes(), nil
+	}
+
+	body := io.Reader(resp.Body)
+	if limit > 0 {
+		// Read one byte past the limit to tell if it was exceeded.
+		body = io.LimitReader(resp.Body, limit-n+1)
+	}
+	if _, err := buf.ReadFrom(body); err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(buf.Len()) > limit {
+		return nil, ErrOriginalTooBig
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Close shuts down a Proxy and its Pool, once any work left behind by
+// requests that were abandoned by their clients, and any thumbnails still
+// being written to Cache, have finished.  No
+// requests may be in progress.
 func (p *Proxy) Close() {
+	p.requests.Wait()
+	p.fetches.Wait()
+	p.caching.Wait()
 	close(p.active)
 	p.pool.Close()
 	*p = Proxy{}
@@ -174,6 +556,30 @@ func isNotModified(req, resp http.Header) bool {
 	return lastMod != "" && since == lastMod
 }
 
+// direct calls DirectorErr if it's set, and otherwise Director, whose
+// status code becomes a *StatusError.
+func (p *Proxy) direct(r *http.Request) (Options, error) {
+	if p.DirectorErr != nil {
+		return p.DirectorErr(r)
+	}
+
+	options, status := p.Director(r)
+	if status != 0 {
+		return Options{}, &StatusError{Status: status}
+	}
+	return options, nil
+}
+
+func directorError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var se *StatusError
+	if errors.As(err, &se) {
+		status = se.Status
+	}
+
+	http.Error(w, err.Error(), status)
+}
+
 func proxyError(w http.ResponseWriter, err error, status int) {
 	switch status {
 	case http.StatusBadRequest,
@@ -188,8 +594,10 @@ func proxyError(w http.ResponseWriter, err error, status int) {
 		switch {
 		case errors.Is(err, format.ErrUnknownFormat), errors.Is(err, ErrTooSmall):
 			status = http.StatusUnsupportedMediaType
-		case errors.Is(err, ErrTooBig):
+		case errors.Is(err, ErrTooBig), errors.Is(err, ErrOriginalTooBig):
 			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, ErrOriginUnavailable), errors.Is(err, ErrProcessingTimeout):
+			status = http.StatusServiceUnavailable
 		case errors.Is(err, ErrAborted), errors.Is(err, context.Canceled):
 			status = 499 // Nginx error for "Client closed connection"
 		case isTimeout(err):
@@ -1,11 +1,15 @@
 package thumbnail
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -53,8 +57,330 @@ func TestProxyErrors(t *testing.T) {
 	ps.status = 403
 	assert.Equal(t, ps.getStatus("2px.png"), 403)
 
-	// Make sure NewProxy returns nil on bad input
+	// Make sure other director errors are returned as StatusBadRequest.
+	ps.err = errors.New("bad width")
+	body, status := ps.get("2px.png")
+	assert.Equal(t, status, http.StatusBadRequest)
+	assert.Equal(t, string(body), "bad width\n")
+	ps.err = nil
+
+	// A Director without DirectorErr refuses with just a status code.
+	ps.proxy.DirectorErr = nil
+	ps.proxy.Director = func(*http.Request) (Options, int) { return Options{}, http.StatusForbidden }
+	body, status = ps.get("2px.png")
+	assert.Equal(t, status, http.StatusForbidden)
+	assert.Equal(t, string(body), "Forbidden\n")
+
+	// Make sure NewProxy and NewProxyErr return nil on bad input
 	assert.Nil(t, NewProxy(nil, nil, 0, nil))
+	assert.Nil(t, NewProxy(ps.proxy.Director, NewPool(0, 1), 2, nil))
+	assert.Nil(t, NewProxyErr(nil, nil, 0, nil))
+	assert.Nil(t, NewProxyErr(ps.director, nil, 0, nil))
+	assert.Nil(t, NewProxyErr(ps.director, NewPool(0, 1), 2, nil))
+}
+
+func TestProxyClient(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 100, Height: 100}
+
+	// The deprecated Client fetches the originals if Origin isn't set.
+	client := ps.proxy.Origin.(*http.Client)
+	ps.proxy.Client, ps.proxy.Origin = client, nil
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+
+	// As it does for a Proxy from NewProxy.
+	p := NewProxy(func(*http.Request) (Options, int) { return Options{}, 0 }, NewPool(0, 1), 2, client)
+	if assert.NotNil(t, p) {
+		assert.Equal(t, client, p.Client)
+		assert.Nil(t, p.Origin)
+		p.Close()
+	}
+}
+
+func TestProxyNegotiateFormat(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// Without NegotiateFormat, ignore the Accept header.
+	body, header := ps.getHeader("watermelon.jpg", http.Header{"Accept": {"image/webp"}})
+	assert.Equal(t, format.DetectFormat(body), format.Jpeg)
+	assert.Equal(t, header.Get("Vary"), "")
+
+	ps.proxy.NegotiateFormat = true
+	for _, test := range []struct {
+		accept []string
+		format format.Format
+	}{
+		{nil, format.Jpeg},
+		{[]string{"image/png,image/*;q=0.8,*/*;q=0.5"}, format.Jpeg},
+		{[]string{"image/webp;q=0"}, format.Jpeg},
+		{[]string{"image/webp,*/*"}, format.Webp},
+		{[]string{"image/png", "IMAGE/WEBP; q=0.9"}, format.Webp},
+	} {
+		body, header := ps.getHeader("watermelon.jpg", http.Header{"Accept": test.accept})
+		assert.Equal(t, format.DetectFormat(body), test.format, "Accept: %v", test.accept)
+		assert.Equal(t, header.Get("Vary"), "Accept", "Accept: %v", test.accept)
+	}
+
+	// AVIF is preferred over WebP, if VIPS can write it.
+	want := format.Avif
+	if !format.Avif.CanSave() {
+		t.Log("VIPS was built without libheif, so expecting WebP instead of AVIF.")
+		want = format.Webp
+	}
+	body, header = ps.getHeader("watermelon.jpg", http.Header{"Accept": {"image/avif,image/webp,*/*"}})
+	assert.Equal(t, format.DetectFormat(body), want)
+	assert.Equal(t, header.Get("Content-Type"), want.String())
+
+	// Negotiated WebP is lossy unless LosslessWebp is set, even if
+	// Director allowed lossless output.
+	ps.options = Options{Width: 200, Height: 100, Save: format.SaveOptions{Lossless: true}}
+	lossy, _ := ps.getHeader("flowers.png", http.Header{"Accept": {"image/webp"}})
+	assert.Equal(t, format.DetectFormat(lossy), format.Webp)
+	ps.proxy.LosslessWebp = true
+	body, _ = ps.getHeader("flowers.png", http.Header{"Accept": {"image/webp"}})
+	assert.Equal(t, format.DetectFormat(body), format.Webp)
+	assert.True(t, len(body) > len(lossy), "lossless %d <= lossy %d bytes", len(body), len(lossy))
+	ps.proxy.LosslessWebp = false
+
+	// An explicit output format overrides the Accept header.
+	ps.options.Save.Format = format.Png
+	body, header = ps.getHeader("watermelon.jpg", http.Header{"Accept": {"image/webp"}})
+	assert.Equal(t, format.DetectFormat(body), format.Png)
+	assert.Equal(t, header.Get("Vary"), "")
+}
+
+func TestProxyClientHints(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// Without ClientHints, don't ask for them.
+	_, header := ps.getHeader("watermelon.jpg", nil)
+	assert.Equal(t, header.Get("Accept-CH"), "")
+	assert.Equal(t, header.Get("Vary"), "")
+
+	ps.proxy.ClientHints = []string{"Sec-CH-DPR", "DPR"}
+	_, header = ps.getHeader("watermelon.jpg", nil)
+	assert.Equal(t, header.Get("Accept-CH"), "Sec-CH-DPR, DPR")
+	assert.Equal(t, header.Values("Vary"), []string{"Sec-CH-DPR, DPR"})
+
+	// Errors ask for them too.
+	_, header = ps.getHeader("notfound.txt", nil)
+	assert.Equal(t, header.Get("Accept-CH"), "Sec-CH-DPR, DPR")
+}
+
+func TestProxyCache(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.proxy.Cache = &memCache{}
+	ps.options = Options{Width: 200, Height: 100, Crop: true}
+
+	// The second request is served from the cache.
+	first, header := ps.getHeader("watermelon.jpg", nil)
+	assert.Equal(t, format.DetectFormat(first), format.Jpeg)
+	ps.proxy.caching.Wait()
+	second, header2 := ps.getHeader("watermelon.jpg", nil)
+	assert.Equal(t, first, second)
+	assert.Equal(t, header.Get("Last-Modified"), header2.Get("Last-Modified"))
+	assert.Equal(t, header2.Get("Content-Type"), "image/jpeg")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	// A conditional request can be answered from the cache, too.
+	_, resp := ps.do("watermelon.jpg", http.Header{"If-Modified-Since": {header.Get("Last-Modified")}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	// Different options are cached separately.
+	ps.options = Options{Width: 100, Height: 100, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 100, 100))
+	ps.proxy.caching.Wait()
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 100, 100))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ps.fetches))
+
+	// Stale thumbnails are revalidated with origin.
+	ps.cacheControl.Store("no-cache")
+	ps.options = Options{Width: 50, Height: 50, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 50, 50))
+	ps.proxy.caching.Wait()
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 50, 50))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&ps.fetches))
+
+	// And some can't be cached at all.
+	ps.cacheControl.Store("no-store")
+	ps.options = Options{Width: 60, Height: 60, Crop: true}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 60, 60))
+	ps.proxy.caching.Wait()
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 60, 60))
+	assert.Equal(t, int32(6), atomic.LoadInt32(&ps.fetches))
+}
+
+func TestProxyOriginals(t *testing.T) {
+	ps := newProxyServer(100*time.Millisecond, time.Minute)
+	defer ps.close()
+
+	ps.proxy.Originals = NewOriginalCache(1 << 20)
+	ps.options = Options{Width: 100, Height: 100}
+
+	// Concurrent requests share one fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	// Later ones, for any size, use the cached original.
+	ps.options = Options{Width: 50, Height: 50}
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 38, 50))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	// And answer conditional requests without fetching it again.
+	_, header := ps.getHeader("watermelon.jpg", nil)
+	_, resp := ps.do("watermelon.jpg", http.Header{"If-Modified-Since": {header.Get("Last-Modified")}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	stats := ps.proxy.Originals.Stats()
+	assert.Equal(t, int64(3), stats.Hits)
+	assert.Equal(t, int64(2), stats.Misses)
+
+	// Originals that can't be cached are fetched every time.
+	ps.cacheControl.Store("no-store")
+	ps.options = Options{Save: format.SaveOptions{Lossless: true}}
+	assert.Nil(t, ps.isSize("2px.png", format.Png, 2, 3))
+	assert.Nil(t, ps.isSize("2px.png", format.Png, 2, 3))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ps.fetches))
+}
+
+func TestProxyCoalesce(t *testing.T) {
+	ps := newProxyServer(200*time.Millisecond, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 100, Height: 100}
+
+	// One client gives up, without affecting the others.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ps.server.URL+"/watermelon.jpg", http.NoBody)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.NotNil(t, err)
+	}()
+
+	// Identical requests share one fetch and thumbnail.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ps.fetches))
+
+	// Later ones start over.
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ps.fetches))
+}
+
+func TestProxyMaxOriginalBytes(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 100, Height: 100}
+	ps.proxy.MaxOriginalBytes = 10000
+
+	// Refuse large originals by their Content-Length, or as they arrive.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("watermelon.jpg"))
+	atomic.StoreInt32(&ps.chunked, 1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("watermelon.jpg"))
+
+	// Allow ones within the limit either way.
+	ps.proxy.MaxOriginalBytes = 49106
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+	atomic.StoreInt32(&ps.chunked, 0)
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+	ps.proxy.MaxOriginalBytes = 100
+	assert.Equal(t, http.StatusOK, ps.getStatus("2px.png"))
+
+	// Refuse ones over the limit, even if smaller than what's read to
+	// check their format.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("orient2.jpg"))
+	atomic.StoreInt32(&ps.chunked, 1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, ps.getStatus("orient2.jpg"))
+	assert.Equal(t, http.StatusOK, ps.getStatus("2px.png"))
+	atomic.StoreInt32(&ps.chunked, 0)
+
+	// Refuse non-images as soon as they're seen.
+	ps.proxy.MaxOriginalBytes = 0
+	assert.Equal(t, http.StatusUnsupportedMediaType, ps.getStatus("notimage.txt"))
+}
+
+func TestProxyUpstreams(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	ps.options = Options{Width: 100, Height: 100}
+
+	// Retry until the origin recovers.
+	ps.proxy.Retries = 2
+	ps.proxy.RetryBackoff = time.Millisecond
+	atomic.StoreInt32(&ps.failures, 2)
+	assert.Nil(t, ps.isSize("watermelon.jpg", format.Jpeg, 75, 100))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ps.fetches))
+	assert.Equal(t, int64(2), ps.proxy.UpstreamStats().Retries)
+
+	// Open the circuit breaker once retries run out.
+	ps.proxy.Retries = 0
+	ps.proxy.BreakerFailures = 1
+	ps.proxy.BreakerCooldown = time.Minute
+	atomic.StoreInt32(&ps.failures, 1)
+	assert.Equal(t, http.StatusBadGateway, ps.getStatus("watermelon.jpg"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&ps.fetches))
+
+	// Then refuse requests for that origin without fetching.
+	assert.Equal(t, http.StatusServiceUnavailable, ps.getStatus("watermelon.jpg"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&ps.fetches))
+
+	stats := ps.proxy.UpstreamStats()
+	assert.Equal(t, int64(1), stats.BreakerTrips)
+	assert.Equal(t, int64(1), stats.BreakerRejects)
+	assert.Equal(t, int64(1), stats.OpenBreakers)
+	assert.Equal(t, int64(0), stats.Fetching)
+}
+
+func TestProxyCheck(t *testing.T) {
+	ps := newProxyServer(0, time.Minute)
+	defer ps.close()
+
+	assert.Nil(t, ps.proxy.Check(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, ps.proxy.Check(ctx))
+
+	active, maxActive := ps.proxy.Active()
+	assert.Equal(t, 0, active)
+	assert.Equal(t, 2, maxActive)
 }
 
 func TestProxyTimeout(t *testing.T) {
@@ -66,51 +392,100 @@ func TestProxyTimeout(t *testing.T) {
 }
 
 type proxyServer struct {
-	proxy   *Proxy
-	server  *httptest.Server
-	origin  *httptest.Server
-	options Options
-	status  int
-	scheme  string
-	host    string
+	proxy        *Proxy
+	server       *httptest.Server
+	origin       *httptest.Server
+	options      Options
+	status       int
+	err          error
+	scheme       string
+	host         string
+	cacheControl atomic.Value // Of string, sent by origin.
+	fetches      int32        // Requests to origin.
+	chunked      int32        // Origin leaves out Content-Length if set.
+	failures     int32        // Origin answers 503 to this many requests.
+}
+
+// chunkedWriter leaves out the Content-Length header.
+type chunkedWriter struct {
+	http.ResponseWriter
+}
+
+func (w chunkedWriter) WriteHeader(status int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
 }
 
 func newProxyServer(delay, timeout time.Duration) *proxyServer {
+	ps := &proxyServer{}
+	ps.cacheControl.Store("max-age=1234")
+
 	// Static http server that serves our test images, with a delay.
 	fs := http.FileServer(http.Dir(imageDirectory))
-	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ps.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ps.fetches, 1)
 		time.Sleep(delay)
-		w.Header().Set("Cache-Control", "max-age=1234")
+		if atomic.AddInt32(&ps.failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.StoreInt32(&ps.failures, 0)
+		w.Header().Set("Cache-Control", ps.cacheControl.Load().(string))
+		if atomic.LoadInt32(&ps.chunked) != 0 {
+			w = chunkedWriter{w}
+		}
 		fs.ServeHTTP(w, r)
 	}))
 
-	u, err := url.Parse(origin.URL)
+	u, err := url.Parse(ps.origin.URL)
 	if err != nil {
 		panic("Bad origin URL")
 	}
-
-	ps := &proxyServer{
-		origin: origin,
-		scheme: u.Scheme,
-		host:   u.Host,
-	}
+	ps.scheme = u.Scheme
+	ps.host = u.Host
 
 	// Proxy http server that fetches and thumbnails images from origin
-	ps.proxy = NewProxy(ps.director, NewPool(0, 1), 2, &http.Client{Timeout: timeout})
+	ps.proxy = NewProxyErr(ps.director, NewPool(0, 1), 2, &http.Client{Timeout: timeout})
 	ps.server = httptest.NewServer(ps.proxy)
 
 	return ps
 }
 
-func (ps *proxyServer) director(req *http.Request) (Options, int) {
+func (ps *proxyServer) director(req *http.Request) (Options, error) {
+	if ps.err != nil {
+		return Options{}, ps.err
+	}
+	if ps.status != 0 {
+		return Options{}, &StatusError{Status: ps.status}
+	}
 	req.URL.Scheme = ps.scheme
 	req.URL.Host = ps.host
-	return ps.options, ps.status
+	return ps.options, nil
 }
 
 func (ps *proxyServer) get(filename string) ([]byte, int) {
-	u := ps.server.URL + "/" + filename
-	resp, err := http.Get(u)
+	body, resp := ps.do(filename, nil)
+	return body, resp.StatusCode
+}
+
+func (ps *proxyServer) getHeader(filename string, header http.Header) ([]byte, http.Header) {
+	body, resp := ps.do(filename, header)
+	if resp.StatusCode != 200 {
+		panic(fmt.Sprintf("got HTTP error %d: %s", resp.StatusCode, string(body)))
+	}
+	return body, resp.Header
+}
+
+func (ps *proxyServer) do(filename string, header http.Header) ([]byte, *http.Response) {
+	req, err := http.NewRequest("GET", ps.server.URL+"/"+filename, http.NoBody)
+	if err != nil {
+		panic(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		panic(err)
 	}
@@ -129,7 +504,7 @@ func (ps *proxyServer) get(filename string) ([]byte, int) {
 		panic("Cache-control shouldn't be included in error response")
 	}
 
-	return body, resp.StatusCode
+	return body, resp
 }
 
 func (ps *proxyServer) getStatus(filename string) int {
@@ -156,6 +531,28 @@ func (ps *proxyServer) isSize(filename string, f format.Format, width, height in
 	return nil
 }
 
+// memCache is a Cache that keeps everything in memory.
+type memCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (c *memCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	return value, ok
+}
+
+func (c *memCache) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string][]byte)
+	}
+	c.values[key] = value
+}
+
 func (ps *proxyServer) close() {
 	ps.server.Close()
 	ps.proxy.Close()
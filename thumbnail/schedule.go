@@ -0,0 +1,177 @@
+package thumbnail
+
+import (
+	"sync"
+)
+
+// Priority selects which requests a Pool runs first.
+type Priority int
+
+// Various Priority values, from most to least urgent.
+const (
+	// PriorityInteractive is for requests that someone is waiting for.
+	PriorityInteractive Priority = iota
+	// PriorityBatch is for background work, such as filling a cache,
+	// which only runs when no interactive requests are waiting.
+	PriorityBatch
+
+	numPriorities
+)
+
+// Priorities lists every Priority, from most to least urgent.
+var Priorities = []Priority{PriorityInteractive, PriorityBatch}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBatch:
+		return "batch"
+	}
+	return "unknown"
+}
+
+// scheduler queues Requests for a Pool's workers.  Requests of a more
+// urgent Priority always go first.  Within a Priority, each tenant gets a
+// share of the workers in proportion to its weight, using stride
+// scheduling, and its own requests go in order.
+type scheduler struct {
+	mu      sync.Mutex
+	ready   *sync.Cond
+	classes [numPriorities]schedulerClass
+	weights map[string]int
+	closed  bool
+}
+
+// schedulerClass holds the requests of one Priority.
+type schedulerClass struct {
+	tenants map[string]*tenantQueue
+	// pass is the pass of the tenant served last, which tenants that
+	// were idle start from, so they can't catch up on a backlog of turns.
+	pass  float64
+	depth int
+}
+
+type tenantQueue struct {
+	requests []*Request
+	// pass grows by 1/weight each time the tenant is served; the waiting
+	// tenant with the lowest pass goes next.
+	pass float64
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{weights: make(map[string]int)}
+	s.ready = sync.NewCond(&s.mu)
+	for i := range s.classes {
+		s.classes[i].tenants = make(map[string]*tenantQueue)
+	}
+	return s
+}
+
+// push queues q to be returned by pop.
+func (s *scheduler) push(q *Request) {
+	priority := q.Options.Priority
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityBatch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &s.classes[priority]
+	t, ok := c.tenants[q.Options.Tenant]
+	if !ok {
+		t = &tenantQueue{pass: c.pass}
+		c.tenants[q.Options.Tenant] = t
+	}
+	t.requests = append(t.requests, q)
+	c.depth++
+
+	s.ready.Signal()
+}
+
+// pop waits for the next Request to run, and returns nil once the
+// scheduler is closed and empty.
+func (s *scheduler) pop() *Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for i := range s.classes {
+			if q := s.classes[i].pop(s.weights); q != nil {
+				return q
+			}
+		}
+		if s.closed {
+			return nil
+		}
+		s.ready.Wait()
+	}
+}
+
+// pop returns the next Request of the tenant with the lowest pass, if
+// any are waiting.  Must hold scheduler.mu.
+func (c *schedulerClass) pop(weights map[string]int) *Request {
+	var next *tenantQueue
+	var tenant string
+	for name, t := range c.tenants {
+		if next == nil || t.pass < next.pass || (t.pass == next.pass && name < tenant) {
+			next, tenant = t, name
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	q := next.requests[0]
+	next.requests[0] = nil
+	next.requests = next.requests[1:]
+	c.depth--
+
+	c.pass = next.pass
+	weight := weights[tenant]
+	if weight <= 0 {
+		weight = 1
+	}
+	next.pass += 1 / float64(weight)
+
+	// Forget idle tenants, which start again from the current pass.
+	if len(next.requests) == 0 {
+		delete(c.tenants, tenant)
+	}
+
+	return q
+}
+
+// setWeight sets the share of workers given to tenant's requests,
+// relative to other tenants of the same Priority (default 1).
+func (s *scheduler) setWeight(tenant string, weight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if weight <= 0 {
+		delete(s.weights, tenant)
+		return
+	}
+	s.weights[tenant] = weight
+}
+
+// depth returns how many requests of priority are waiting.
+func (s *scheduler) depth(priority Priority) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if priority < 0 || priority >= numPriorities {
+		return 0
+	}
+	return s.classes[priority].depth
+}
+
+// close makes pop return nil once every queued Request has been returned.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.ready.Broadcast()
+}
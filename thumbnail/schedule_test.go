@@ -0,0 +1,102 @@
+package thumbnail
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler()
+
+	batch := scheduled(PriorityBatch, "a")
+	interactive := scheduled(PriorityInteractive, "b")
+	s.push(batch)
+	s.push(interactive)
+	assert.Equal(t, 1, s.depth(PriorityInteractive))
+	assert.Equal(t, 1, s.depth(PriorityBatch))
+
+	// Interactive requests always go first.
+	assert.Equal(t, interactive, s.pop())
+	assert.Equal(t, batch, s.pop())
+	assert.Equal(t, 0, s.depth(PriorityBatch))
+
+	// Out of range priorities are treated as batch.
+	odd := scheduled(Priority(99), "a")
+	s.push(odd)
+	assert.Equal(t, 1, s.depth(PriorityBatch))
+	assert.Equal(t, 0, s.depth(Priority(99)))
+	assert.Equal(t, odd, s.pop())
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	s := newScheduler()
+	s.setWeight("a", 2)
+
+	var a []*Request
+	for i := 0; i < 6; i++ {
+		a = append(a, scheduled(PriorityBatch, "a"))
+		s.push(a[i])
+	}
+	for i := 0; i < 6; i++ {
+		s.push(scheduled(PriorityBatch, "b"))
+	}
+
+	// Tenant a gets twice the turns of tenant b, in its own order.
+	counts := map[string]int{}
+	var gotA []*Request
+	for i := 0; i < 6; i++ {
+		q := s.pop()
+		counts[q.Options.Tenant]++
+		if q.Options.Tenant == "a" {
+			gotA = append(gotA, q)
+		}
+	}
+	assert.Equal(t, map[string]int{"a": 4, "b": 2}, counts)
+	assert.Equal(t, a[:4], gotA)
+}
+
+func TestSchedulerIdleTenant(t *testing.T) {
+	s := newScheduler()
+
+	for i := 0; i < 10; i++ {
+		s.push(scheduled(PriorityBatch, "a"))
+	}
+	for i := 0; i < 5; i++ {
+		s.pop()
+	}
+
+	// A tenant that was idle takes turns, rather than catching up on
+	// the turns it didn't need.
+	for i := 0; i < 3; i++ {
+		s.push(scheduled(PriorityBatch, "b"))
+	}
+	var tenants []string
+	for i := 0; i < 4; i++ {
+		tenants = append(tenants, s.pop().Options.Tenant)
+	}
+	assert.Equal(t, []string{"b", "a", "b", "a"}, tenants)
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler()
+
+	// pop waits for a request.
+	q := scheduled(PriorityInteractive, "")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.push(q)
+	}()
+	assert.Equal(t, q, s.pop())
+
+	// Requests queued before close are still returned.
+	s.push(q)
+	s.close()
+	assert.Equal(t, q, s.pop())
+	assert.Nil(t, s.pop())
+}
+
+func scheduled(priority Priority, tenant string) *Request {
+	return &Request{Options: Options{Priority: priority, Tenant: tenant}}
+}
@@ -1,9 +1,8 @@
 package thumbnail
 
 import (
-	"log"
+	"context"
 	"math"
-	"time"
 
 	"github.com/die-net/fotomat/v2/format"
 	"github.com/die-net/fotomat/v2/vips"
@@ -17,21 +16,82 @@ const (
 // Options specified in o and returns a compressed image.
 // Should be called from a thread pool with runtime.LockOSThread() locked.
 func Thumbnail(blob []byte, o Options) ([]byte, error) {
-	if o.MaxProcessingDuration > 0 {
-		timer := time.AfterFunc(o.MaxProcessingDuration, func() {
-			log.Fatalf("Thumbnail took longer than %v", o.MaxProcessingDuration)
-		})
-		defer timer.Stop()
-	}
+	return ThumbnailContext(context.Background(), blob, o)
+}
 
+// ThumbnailContext is like Thumbnail, but once ctx is done, it stops
+// processing as soon as it can and returns ErrAborted.
+func ThumbnailContext(ctx context.Context, blob []byte, o Options) ([]byte, error) {
 	// Free some thread-local caches. Safe to call unnecessarily.
 	defer vips.ThreadShutdown()
 
+	if hasAborted(ctx) {
+		return nil, ErrAborted
+	}
+
+	if o.MaxProcessingDuration <= 0 && ctx.Done() == nil {
+		return thumbnail(blob, o, nil)
+	}
+
+	kill := vips.NewKill()
+	defer kill.Free()
+
+	var w *watchdog
+	if o.MaxProcessingDuration > 0 {
+		w = startWatchdog(kill, o)
+	}
+	if ctx.Done() != nil {
+		defer killOnDone(ctx, kill)()
+	}
+
+	thumb, err := thumbnail(blob, o, kill)
+	if w != nil && w.stop() {
+		return nil, ErrProcessingTimeout
+	}
+	if err != nil && hasAborted(ctx) {
+		return nil, ErrAborted
+	}
+
+	return thumb, err
+}
+
+// killOnDone sets kill once ctx is done, until the returned function is
+// called.
+func killOnDone(ctx context.Context, kill *vips.Kill) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			kill.Set()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// thumbnail does the work of Thumbnail, stopping between steps and image
+// evaluation once kill, if not nil, is set.
+func thumbnail(blob []byte, o Options, kill *vips.Kill) ([]byte, error) {
 	m, err := format.MetadataBytes(blob)
 	if err != nil {
 		return nil, err
 	}
 
+	// Rotating would mix up the frames of an animation, so leave it
+	// as stored.
+	animated := o.animated(m)
+	if animated {
+		m.Width, m.Height = m.Orientation.Dimensions(m.Width, m.Height)
+		m.Orientation = format.Undefined
+	}
+
 	o, err = o.Check(m)
 	if err != nil {
 		return nil, err
@@ -42,23 +102,33 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 		o.Save.Lossless = false
 	}
 
-	// Figure out size to scale image down to.  For crop, this is the
-	// intermediate size the original image would have to be scaled to
-	// be cropped to requested size.
-	iw, ih, trustWidth := scaleAspect(m.Width, m.Height, o.Width, o.Height, !o.Crop)
+	// Figure out size to scale image to.
+	iw, ih, trustWidth := o.scaledSize(m)
 
 	// Are we shrinking by more than 2.5%?
 	shrinking := iw < m.Width-m.Width/40 && ih < m.Height-m.Height/40
 
+	if killed(kill) {
+		return nil, ErrAborted
+	}
+
 	// Figure out the jpeg/webp shrink factor and load image.
 	// Jpeg shrink rounds up the number of pixels.
 	psf := preShrinkFactor(m.Width, m.Height, iw, ih, trustWidth, m.Format == format.Jpeg)
-	image, err := load(blob, m.Format, psf)
+	image, err := load(blob, m.Format, psf, animated)
 	if err != nil {
 		return nil, err
 	}
 	defer image.Close()
 
+	if kill != nil {
+		image.SetKill(kill)
+	}
+
+	if animated {
+		image.ImageRemove(vips.ExifOrientation)
+	}
+
 	if err := srgb(image); err != nil {
 		return nil, err
 	}
@@ -67,6 +137,10 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 		return nil, err
 	}
 
+	if killed(kill) {
+		return nil, ErrAborted
+	}
+
 	// Make sure we generate images with 8 bits per channel.  Do this before the
 	// rotate to reduce the amount of data that needs to be copied.
 	if image.ImageGetBandFormat() != vips.BandFormatUchar {
@@ -76,7 +150,7 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 	}
 
 	if o.Crop {
-		if err := crop(image, o.Width, o.Height); err != nil {
+		if err := crop(image, o.Width, o.Height, o.CropMode, o.Focus); err != nil {
 			return nil, err
 		}
 	}
@@ -93,10 +167,34 @@ func Thumbnail(blob []byte, o Options) ([]byte, error) {
 		return nil, err
 	}
 
+	if o.Pad {
+		if err := pad(image, o.Width, o.Height, o.Background, o.Save.Format); err != nil {
+			return nil, err
+		}
+	}
+
+	if killed(kill) {
+		return nil, ErrAborted
+	}
+
 	return format.Save(image, o.Save)
 }
 
-func load(blob []byte, f format.Format, shrink int) (*vips.Image, error) {
+// killed returns true if kill is set.
+func killed(kill *vips.Kill) bool {
+	return kill != nil && kill.IsSet()
+}
+
+func load(blob []byte, f format.Format, shrink int, animated bool) (*vips.Image, error) {
+	if animated {
+		// Shrinking on load doesn't keep frames evenly sized.
+		if f == format.Gif {
+			return vips.GifloadBufferAnimated(blob)
+		} else if f == format.Webp {
+			return vips.WebploadBufferAnimated(blob)
+		}
+	}
+
 	if shrink > 1 {
 		if f == format.Jpeg {
 			return vips.JpegloadBufferShrink(blob, shrink)
@@ -106,6 +204,8 @@ func load(blob []byte, f format.Format, shrink int) (*vips.Image, error) {
 			return vips.PdfloadBufferShrink(blob, shrink)
 		} else if f == format.Svg {
 			return vips.SvgloadBufferShrink(blob, shrink)
+		} else if f == format.Avif || f == format.Heif {
+			return vips.HeifloadBufferShrink(blob, shrink)
 		}
 	}
 
@@ -149,7 +249,10 @@ func resize(image *vips.Image, iw, ih int, blurSigma float64, sharpen bool) erro
 	wshrink := float64(m.Width) / (float64(iw) * fastResizeLimit)
 	hshrink := float64(m.Height) / (float64(ih) * fastResizeLimit)
 	shrink := math.Floor(math.Min(wshrink, hshrink))
-	if shrink >= 2 {
+	// Shrinking a strip of animation frames would misalign them unless
+	// the frame height happens to be a multiple of shrink.
+	pages := image.Ysize() / m.Height
+	if shrink >= 2 && pages == 1 {
 		// Shrink rounds down the number of pixels.
 		if err := image.Shrink(shrink, shrink); err != nil {
 			return err
@@ -158,10 +261,16 @@ func resize(image *vips.Image, iw, ih int, blurSigma float64, sharpen bool) erro
 	}
 
 	// If necessary, do a high-quality resize to scale to final size.
-	if iw < m.Width || ih < m.Height {
+	// Enlarging uses an interpolator rather than shrinking.
+	if iw != m.Width || ih != m.Height {
 		if err := image.Resize(float64(iw)/float64(m.Width), float64(ih)/float64(m.Height)); err != nil {
 			return err
 		}
+		if pages > 1 {
+			if err := image.SetPageHeight(ih); err != nil {
+				return err
+			}
+		}
 	}
 
 	if blurSigma > 0.0 {
@@ -186,7 +295,7 @@ func resize(image *vips.Image, iw, ih int, blurSigma float64, sharpen bool) erro
 	return nil
 }
 
-func crop(image *vips.Image, ow, oh int) error {
+func crop(image *vips.Image, ow, oh int, mode CropMode, focus FocalPoint) error {
 	m := format.MetadataImage(image)
 
 	// If we have nothing to do, return.
@@ -194,14 +303,79 @@ func crop(image *vips.Image, ow, oh int) error {
 		return nil
 	}
 
+	animated := image.Ysize() > m.Height
+
+	// Smartcrop works on the image as stored, so it needs the stored
+	// width and height rather than coordinate translation.
+	if !animated && (mode == CropEntropy || mode == CropAttention) {
+		interesting := vips.InterestingEntropy
+		if mode == CropAttention {
+			interesting = vips.InterestingAttention
+		}
+		w, h := m.Orientation.Dimensions(ow, oh)
+		return image.Smartcrop(w, h, interesting)
+	}
+
 	// Center horizontally
 	x := (m.Width - ow + 1) / 2
-	// Assume faces are higher up vertically
-	y := (m.Height - oh + 1) / 4
+	y := (m.Height - oh + 1) / 2
+	switch mode {
+	case CropTop:
+		// Assume faces are higher up vertically
+		y = (m.Height - oh + 1) / 4
+	case CropFocus:
+		x = focusOffset(focus.X, ow, m.Width)
+		y = focusOffset(focus.Y, oh, m.Height)
+	default:
+	}
 
 	if x < 0 || y < 0 {
 		panic("Bad crop offsets!")
 	}
 
+	// Crop every frame of an animation the same way.
+	if animated {
+		return image.ExtractAreaPages(x, y, ow, oh)
+	}
+
 	return image.ExtractArea(m.Orientation.Crop(ow, oh, x, y, m.Width, m.Height))
 }
+
+// pad centres an image that has already been rotated upright within
+// ow x oh, filling the rest with background.
+func pad(image *vips.Image, ow, oh int, background Color, f format.Format) error {
+	m := format.MetadataImage(image)
+
+	// If we have nothing to do, return.
+	if ow == m.Width && oh == m.Height {
+		return nil
+	}
+
+	if image.ImageGetBands() < 3 {
+		if err := image.Colourspace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+
+	// Adding transparency would make Save pick PNG for an opaque
+	// image, so only do it if it was asked for by the output format.
+	if background.A < 255 && !image.HasAlpha() {
+		switch f {
+		case format.Png, format.Gif, format.Webp, format.Avif, format.Heif:
+			if err := image.AddAlpha(); err != nil {
+				return err
+			}
+		default:
+			if background.A == 0 {
+				background = Color{R: 255, G: 255, B: 255}
+			}
+		}
+	}
+
+	bg := []float64{float64(background.R), float64(background.G), float64(background.B)}
+	if image.HasAlpha() {
+		bg = append(bg, float64(background.A))
+	}
+
+	return image.EmbedBackground((ow-m.Width)/2, (oh-m.Height)/2, ow, oh, bg)
+}
@@ -1,10 +1,13 @@
 package thumbnail
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -43,12 +46,16 @@ func TestValidation(t *testing.T) {
 	// Load a big-endian CIELAB LZW TIFF.
 	assert.Nil(t, tryNew("cielab.tiff"))
 
+	// Refuse HEIC unless it is allowed.
+	_, err := Thumbnail(image("2px.heic"), Options{Width: 200, Height: 200})
+	assert.Equal(t, err, format.ErrUnknownFormat)
+
 	// Return ErrTooBig on a 34000x16 PNG image.
 	assert.Equal(t, tryNew("34000px.png"), ErrTooBig)
 
 	// Refuse to load a 213328 pixel JPEG image into 1000 pixel buffer.
 	// TODO: Add back MaxBufferPixels.
-	_, err := Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 300, MaxBufferPixels: 1000})
+	_, err = Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 300, MaxBufferPixels: 1000})
 	assert.Equal(t, err, ErrTooBig)
 
 	// Succeed in loading a 213328 pixel JPEG image into 10000 pixel buffer.
@@ -56,8 +63,33 @@ func TestValidation(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestThumbnailContext(t *testing.T) {
+	img := image("watermelon.jpg")
+	o := Options{Width: 200, Height: 200}
+
+	thumb, err := ThumbnailContext(context.Background(), img, o)
+	assert.Nil(t, err)
+	assert.NotNil(t, thumb)
+
+	// Nothing is done once ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ThumbnailContext(ctx, img, o)
+	assert.Equal(t, ErrAborted, err)
+
+	// Which sets kill, stopping work partway.
+	kill := vips.NewKill()
+	defer kill.Free()
+	defer killOnDone(ctx, kill)()
+	for !kill.IsSet() {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = thumbnail(img, o, kill)
+	assert.Equal(t, ErrAborted, err)
+}
+
 func tryNew(filename string) error {
-	_, err := Thumbnail(image(filename), Options{Width: 200, Height: 200, AllowPdf: true, AllowSvg: true, AllowTiff: true})
+	_, err := Thumbnail(image(filename), Options{Width: 200, Height: 200, AllowPdf: true, AllowSvg: true, AllowTiff: true, AllowHeif: true})
 	return err
 }
 
@@ -123,6 +155,158 @@ func TestCrop(t *testing.T) {
 	}
 }
 
+func TestCropMode(t *testing.T) {
+	// Both are grey, with detail only in their right 40 columns, but
+	// detail6.jpg is stored rotated with an EXIF orientation.
+	for _, filename := range []string{"detail.png", "detail6.jpg"} {
+		img := image(filename)
+
+		for _, test := range []struct {
+			mode   CropMode
+			detail bool
+		}{
+			{CropTop, false},
+			{CropCentre, false},
+			{CropEntropy, true},
+			{CropAttention, true},
+		} {
+			thumb, err := Thumbnail(img, Options{Width: 50, Height: 100, Crop: true, CropMode: test.mode, Save: format.SaveOptions{Format: format.Png}})
+			if !assert.Nil(t, err, "%s mode %d", filename, test.mode) {
+				continue
+			}
+			assert.Nil(t, isSize(thumb, format.Png, 50, 100, false), "%s mode %d", filename, test.mode)
+
+			min, err := bandMin(thumb, 0)
+			if assert.Nil(t, err, "%s mode %d", filename, test.mode) {
+				assert.Equal(t, test.detail, min < 64, "%s mode %d: min %g", filename, test.mode, min)
+			}
+		}
+	}
+}
+
+func TestCropFocus(t *testing.T) {
+	for _, filename := range []string{"detail.png", "detail6.jpg"} {
+		img := image(filename)
+
+		for _, test := range []struct {
+			focus  FocalPoint
+			detail bool
+		}{
+			{FocalPoint{X: 0, Y: 0}, false},
+			{FocalPoint{X: 0.5, Y: 0.5}, false},
+			{FocalPoint{X: 0.9, Y: 0.5}, true},
+			// Clamped to the right edge.
+			{FocalPoint{X: 1, Y: 1}, true},
+		} {
+			thumb, err := Thumbnail(img, Options{Width: 40, Height: 100, Crop: true, CropMode: CropFocus, Focus: test.focus, Save: format.SaveOptions{Format: format.Png}})
+			if !assert.Nil(t, err, "%s focus %v", filename, test.focus) {
+				continue
+			}
+			assert.Nil(t, isSize(thumb, format.Png, 40, 100, false), "%s focus %v", filename, test.focus)
+
+			min, err := bandMin(thumb, 0)
+			if assert.Nil(t, err, "%s focus %v", filename, test.focus) {
+				assert.Equal(t, test.detail, min < 64, "%s focus %v: min %g", filename, test.focus, min)
+			}
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	// An opaque image is padded with white by default, and keeps its
+	// format.
+	thumb, err := Thumbnail(img, Options{Width: 200, Height: 200, Pad: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 200, 200, false))
+		min, err := areaBandMin(thumb, 0, 0, 16, 200, 0)
+		if assert.Nil(t, err) {
+			assert.InDelta(t, 255.0, min, 2)
+		}
+	}
+
+	// It's padded with transparency if the output format has it, or
+	// the image already did.
+	thumb, err = Thumbnail(img, Options{Width: 200, Height: 200, Pad: true, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 200, 200, true))
+	}
+	thumb, err = Thumbnail(image("somealpha.png"), Options{Width: 200, Height: 200, Pad: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 200, 200, true))
+	}
+
+	// An opaque background doesn't need transparency. The 149x200
+	// image is centred, leaving 25 columns of padding on the left.
+	thumb, err = Thumbnail(img, Options{Width: 200, Height: 200, Pad: true, Background: Color{G: 255, A: 255}, Save: format.SaveOptions{Format: format.Png}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Png, 200, 200, false))
+		min, err := areaBandMin(thumb, 0, 0, 20, 200, 1)
+		if assert.Nil(t, err) {
+			assert.Equal(t, min, 255.0)
+		}
+	}
+
+	// Pad after rotating.
+	thumb, err = Thumbnail(image("detail6.jpg"), Options{Width: 200, Height: 200, Pad: true, Background: Color{A: 255}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 200, 200, false))
+	}
+
+	// Pad every frame of an animation.
+	thumb, err = Thumbnail(image("animated.gif"), Options{Width: 64, Height: 64, Pad: true, Animated: true, Background: Color{R: 255, G: 255, B: 255, A: 255}})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isAnimated(thumb, format.Gif, 64, 64, 3))
+	}
+}
+
+func areaBandMin(blob []byte, left, top, width, height, band int) (float64, error) {
+	image, err := format.DetectFormat(blob).LoadBytes(blob)
+	if err != nil {
+		return 0, err
+	}
+	defer image.Close()
+
+	if err := image.ExtractArea(left, top, width, height); err != nil {
+		return 0, err
+	}
+	if err := image.ExtractBand(band, 1); err != nil {
+		return 0, err
+	}
+
+	return image.Min()
+}
+
+func TestEnlarge(t *testing.T) {
+	img := image("watermelon.jpg")
+
+	for _, test := range []struct {
+		options       Options
+		width, height int
+	}{
+		// Without Enlarge, stop at the original 398x536.
+		{Options{Width: 800, Height: 800}, 398, 536},
+		{Options{Width: 800, Height: 800, Crop: true}, 398, 398},
+		// Enlarge up to DefaultMaxEnlarge.
+		{Options{Width: 800, Height: 800, Enlarge: true}, 594, 800},
+		{Options{Width: 1000, Height: 1000, Crop: true, Enlarge: true}, 796, 796},
+		{Options{Width: 2000, Height: 2000, Enlarge: true}, 796, 1072},
+		// Or a given MaxEnlarge.
+		{Options{Width: 2000, Height: 2000, Enlarge: true, MaxEnlarge: 1.5}, 597, 804},
+		{Options{Width: 800, Height: 800, Pad: true, Enlarge: true, MaxEnlarge: 1.2, Background: Color{A: 255}}, 800, 800},
+	} {
+		thumb, err := Thumbnail(img, test.options)
+		if assert.Nil(t, err, "%+v", test.options) {
+			assert.Nil(t, isSize(thumb, format.Jpeg, test.width, test.height, false), "%+v", test.options)
+		}
+	}
+
+	// The enlarged image must fit in MaxBufferPixels.
+	_, err := Thumbnail(img, Options{Width: 800, Height: 800, Enlarge: true, MaxBufferPixels: 400000})
+	assert.Equal(t, err, ErrTooBig)
+}
+
 func TestBlurSharpen(t *testing.T) {
 	img := image("watermelon.jpg")
 
@@ -182,6 +366,159 @@ func TestRotation(t *testing.T) {
 
 		// TODO: Figure out how to test crop.
 	}
+
+	if !format.Heif.CanLoadBytes() {
+		t.Log("Skipping HEIC rotation: VIPS was built without libheif.")
+		return
+	}
+
+	// HEIC is rotated by the decoder, so its EXIF orientation must not
+	// be applied a second time.
+	thumb, err := Thumbnail(image("orient6.heic"), Options{Width: 40, Height: 40, AllowHeif: true})
+	if assert.Nil(t, err) {
+		assert.Nil(t, isSize(thumb, format.Jpeg, 24, 40, false))
+	}
+}
+
+func TestHeifProfile(t *testing.T) {
+	if !format.Heif.CanLoadBytes() {
+		t.Skip("Skipping HEIC input: VIPS was built without libheif.")
+	}
+
+	// icc.heic is solid red, tagged with a profile that swaps the red
+	// and green primaries, so it should be converted to sRGB green.
+	thumb, err := Thumbnail(image("icc.heic"), Options{Width: 16, Height: 16, AllowHeif: true, Save: format.SaveOptions{Format: format.Png}})
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for band, want := range []float64{0, 255, 0} {
+		min, err := bandMin(thumb, band)
+		if assert.Nil(t, err) {
+			assert.InDelta(t, want, min, 32, "band %d", band)
+		}
+	}
+}
+
+func bandMin(blob []byte, band int) (float64, error) {
+	image, err := format.Png.LoadBytes(blob)
+	if err != nil {
+		return 0, err
+	}
+	defer image.Close()
+
+	if err := image.ExtractBand(band, 1); err != nil {
+		return 0, err
+	}
+
+	return image.Min()
+}
+
+func TestAnimation(t *testing.T) {
+	if !format.Gif.CanSave() {
+		t.Skip("Skipping animation: VIPS was built without cgif, so it can't write GIFs.")
+	}
+
+	for _, f := range []format.Format{format.Gif, format.Webp} {
+		img := image("animated." + strings.TrimPrefix(f.String(), "image/"))
+
+		m, err := format.MetadataBytes(img)
+		if !assert.Nil(t, err, "format: %s", f) {
+			continue
+		}
+		assert.Equal(t, m.Format, f, "format: %s", f)
+		assert.Equal(t, m.Pages, 3, "format: %s", f)
+		assert.Equal(t, m.Width, 64, "format: %s", f)
+		assert.Equal(t, m.Height, 48, "format: %s", f)
+
+		// By default, only the first frame is kept.
+		thumb, err := Thumbnail(img, Options{Width: 32, Height: 32, Save: format.SaveOptions{Format: f}})
+		if assert.Nil(t, err, "format: %s", f) {
+			assert.Nil(t, isAnimated(thumb, f, 32, 24, 1), "format: %s", f)
+		}
+
+		// Every frame is scaled and cropped the same way, and saved as
+		// an animated GIF unless WebP is allowed.
+		o := Options{Width: 32, Height: 32, Crop: true, Animated: true}
+		thumb, err = Thumbnail(img, o)
+		if assert.Nil(t, err, "format: %s", f) {
+			assert.Nil(t, isAnimated(thumb, format.Gif, 32, 32, 3), "format: %s", f)
+		}
+		o.Save.AllowWebp = true
+		thumb, err = Thumbnail(img, o)
+		if assert.Nil(t, err, "format: %s", f) {
+			assert.Nil(t, isAnimated(thumb, format.Webp, 32, 32, 3), "format: %s", f)
+		}
+
+		// Formats that can't animate get the first frame.
+		thumb, err = Thumbnail(img, Options{Width: 32, Height: 32, Animated: true, Save: format.SaveOptions{Format: format.Png}})
+		if assert.Nil(t, err, "format: %s", f) {
+			assert.Nil(t, isSize(thumb, format.Png, 32, 24, false), "format: %s", f)
+		}
+
+		// Limit frame count and the pixels of all frames.
+		_, err = Thumbnail(img, Options{Animated: true, MaxFrames: 2})
+		assert.Equal(t, err, ErrTooBig, "format: %s", f)
+		_, err = Thumbnail(img, Options{Animated: true, MaxBufferPixels: 64 * 48 * 2})
+		assert.Equal(t, err, ErrTooBig, "format: %s", f)
+		_, err = Thumbnail(img, Options{Animated: true, MaxFrames: 3, MaxBufferPixels: 64 * 48 * 3})
+		assert.Nil(t, err, "format: %s", f)
+	}
+}
+
+// isAnimated verifies the size, frame count, and frame delays of an
+// animation, and that each frame kept its colour.
+func isAnimated(blob []byte, f format.Format, width, height, frames int) error {
+	if detected := format.DetectFormat(blob); detected != f {
+		return fmt.Errorf("format %s!=%s", detected, f)
+	}
+
+	load := vips.GifloadBufferAnimated
+	if f == format.Webp {
+		load = vips.WebploadBufferAnimated
+	}
+	img, err := load(blob)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	ph := img.ImageGetPageHeight()
+	if img.Xsize() != width || ph != height || img.Ysize() != height*frames {
+		return fmt.Errorf("got %dx%d*%d != want %dx%d*%d", img.Xsize(), ph, img.Ysize()/ph, width, height, frames)
+	}
+
+	if frames > 1 {
+		delay, _ := img.ImageGetAsString("delay")
+		if got := strings.Join(strings.Fields(delay), " "); got != "100 200 300" {
+			return fmt.Errorf("delay %q != \"100 200 300\"", got)
+		}
+	}
+
+	// Frames are solid red, green, then blue.
+	for i := 0; i < frames; i++ {
+		frame, err := img.Copy()
+		if err != nil {
+			return err
+		}
+		err = frame.ExtractArea(0, i*height, width, height)
+		if err == nil {
+			err = frame.ExtractBand(i, 1)
+		}
+		min := 0.0
+		if err == nil {
+			min, err = frame.Min()
+		}
+		frame.Close()
+		if err != nil {
+			return err
+		}
+		if min < 200 {
+			return fmt.Errorf("frame %d band %d min %g < 200", i, i, min)
+		}
+	}
+
+	return nil
 }
 
 func TestConversion(t *testing.T) {
@@ -200,8 +537,15 @@ func TestConversion(t *testing.T) {
 		{"cielab.tiff", format.Tiff, format.Png},
 		{"2px.pdf", format.Pdf, format.Png},
 		{"2px.svg", format.Svg, format.Png},
+		{"2px.heic", format.Heif, format.Png},
+		{"2px.avif", format.Avif, format.Png},
 	}
 	for _, f := range formatTest {
+		if !f.in.CanLoadBytes() {
+			t.Logf("Skipping %s input: VIPS was built without libheif.", f.filename)
+			continue
+		}
+
 		img := image(f.filename)
 
 		m, err := format.MetadataBytes(img)
@@ -212,7 +556,7 @@ func TestConversion(t *testing.T) {
 
 			for _, of := range []format.Format{format.Png, format.Jpeg, format.Webp} {
 				// If we ask for a specific format, it should return that.
-				thumb, err := Thumbnail(img, Options{Width: 1024, Height: 1024, AllowPdf: true, AllowSvg: true, AllowTiff: true, Save: format.SaveOptions{Format: of}})
+				thumb, err := Thumbnail(img, Options{Width: 1024, Height: 1024, AllowPdf: true, AllowSvg: true, AllowTiff: true, AllowHeif: true, Save: format.SaveOptions{Format: of}})
 				if assert.Nil(t, err, "formats: %s -> %s", f.in, of) {
 					alpha := f.in == format.Svg && of != format.Jpeg
 					assert.Nil(t, isSize(thumb, of, 2, 3, alpha), "formats: %s -> %s", f.in, of)
@@ -220,7 +564,7 @@ func TestConversion(t *testing.T) {
 			}
 
 			// If we ask for lossless, it should match the outLossless format.
-			thumb, err := Thumbnail(img, Options{Width: 1024, Height: 1024, AllowPdf: true, AllowSvg: true, AllowTiff: true, Save: format.SaveOptions{Lossless: true}})
+			thumb, err := Thumbnail(img, Options{Width: 1024, Height: 1024, AllowPdf: true, AllowSvg: true, AllowTiff: true, AllowHeif: true, Save: format.SaveOptions{Lossless: true}})
 			if assert.Nil(t, err, "lossless: %s", f.in) {
 				alpha := f.in == format.Svg
 				assert.Nil(t, isSize(thumb, f.outLossless, 2, 3, alpha), "lossless: %s", f.in)
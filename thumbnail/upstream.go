@@ -0,0 +1,251 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/die-net/fotomat/v2/format"
+)
+
+// ErrOriginUnavailable is returned when an origin's circuit breaker is
+// open after repeated failures.
+var ErrOriginUnavailable = errors.New("origin is unavailable")
+
+// maxIdleUpstreams is how many origins' state is kept before forgetting
+// idle ones.
+const maxIdleUpstreams = 1024
+
+// UpstreamStats counts how a Proxy has treated its origins.
+type UpstreamStats struct {
+	// Retries counts fetches retried after a failure.
+	Retries int64
+	// BreakerTrips counts the times an origin's circuit breaker opened.
+	BreakerTrips int64
+	// BreakerRejects counts requests refused by an open circuit breaker.
+	BreakerRejects int64
+	// OpenBreakers is the number of origins whose breaker is open.
+	OpenBreakers int64
+	// LimitWaits counts requests that waited for MaxOriginFetches.
+	LimitWaits int64
+	// Fetching is the number of fetches in progress.
+	Fetching int64
+}
+
+// upstreams tracks each origin's circuit breaker and concurrent fetches.
+// The zero value is ready to use.
+type upstreams struct {
+	mu     sync.Mutex
+	states map[string]*upstream
+	stats  UpstreamStats
+}
+
+// upstream is the state of one origin.
+type upstream struct {
+	refs      int           // Requests using this origin.
+	slots     chan struct{} // Fetches in progress, up to MaxOriginFetches.
+	failures  int           // Consecutive failures.
+	openUntil time.Time     // When an open breaker allows a retry.
+}
+
+// originOf returns the origin that rawURL is fetched from.
+func originOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// acquire returns the state of origin, for use until release.
+func (us *upstreams) acquire(origin string, maxFetches int) *upstream {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	s := us.state(origin, maxFetches)
+	s.refs++
+	return s
+}
+
+// release finishes using the state of origin returned by acquire.
+func (us *upstreams) release(origin string, s *upstream) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	s.refs--
+	if s.refs == 0 && s.failures == 0 && us.states[origin] == s {
+		delete(us.states, origin)
+	}
+}
+
+// state returns the state of origin, creating it if needed.  Must hold mu.
+func (us *upstreams) state(origin string, maxFetches int) *upstream {
+	if s, ok := us.states[origin]; ok {
+		return s
+	}
+
+	if us.states == nil {
+		us.states = make(map[string]*upstream)
+	}
+	if len(us.states) >= maxIdleUpstreams {
+		now := time.Now()
+		for o, s := range us.states {
+			if s.refs == 0 && !now.Before(s.openUntil) {
+				delete(us.states, o)
+			}
+		}
+	}
+
+	s := &upstream{}
+	if maxFetches > 0 {
+		s.slots = make(chan struct{}, maxFetches)
+	}
+	us.states[origin] = s
+	return s
+}
+
+// allow returns false, and counts a rejection, if s's circuit breaker is
+// open at now.  Once it has been open for its cooldown, requests are let
+// through until one succeeds, closing it, or fails, reopening it.
+func (us *upstreams) allow(s *upstream, now time.Time) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if now.Before(s.openUntil) {
+		us.stats.BreakerRejects++
+		return false
+	}
+	return true
+}
+
+// wait waits for a fetch slot for s, returning false if ctx is done or
+// timeout fires first.
+func (us *upstreams) wait(ctx context.Context, s *upstream, timeout <-chan time.Time) bool {
+	if s.slots == nil {
+		return true
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	us.mu.Lock()
+	us.stats.LimitWaits++
+	us.mu.Unlock()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+	case <-timeout:
+	}
+	return false
+}
+
+// done gives back the fetch slot taken by wait.
+func (us *upstreams) done(s *upstream) {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// record notes whether a fetch from origin failed, opening its circuit
+// breaker for cooldown after failures consecutive ones (0=never).
+func (us *upstreams) record(origin string, failed bool, failures int, cooldown time.Duration) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	s, ok := us.states[origin]
+	if !failed {
+		if ok {
+			s.failures = 0
+			s.openUntil = time.Time{}
+		}
+		return
+	}
+	if failures <= 0 {
+		return
+	}
+	if !ok {
+		s = us.state(origin, 0)
+	}
+
+	s.failures++
+	if s.failures >= failures {
+		s.openUntil = time.Now().Add(cooldown)
+		us.stats.BreakerTrips++
+	}
+}
+
+func (us *upstreams) addStat(stat *int64, n int64) {
+	us.mu.Lock()
+	*stat += n
+	us.mu.Unlock()
+}
+
+// UpstreamStats returns how p has treated its origins so far.
+func (p *Proxy) UpstreamStats() UpstreamStats {
+	us := &p.upstreams
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	stats := us.stats
+	now := time.Now()
+	for _, s := range us.states {
+		if now.Before(s.openUntil) {
+			stats.OpenBreakers++
+		}
+	}
+	return stats
+}
+
+// get fetches url, retrying up to Retries times with exponential backoff
+// if the origin can't be reached or reports itself unavailable, and
+// records the outcome with the origin's circuit breaker.
+func (p *Proxy) get(ctx context.Context, url string, header http.Header) ([]byte, http.Header, int, error) {
+	us := &p.upstreams
+	us.addStat(&us.stats.Fetching, 1)
+	defer us.addStat(&us.stats.Fetching, -1)
+
+	for attempt := 0; ; attempt++ {
+		orig, respHeader, status, err := p.getOnce(ctx, url, header)
+
+		retry := retryable(ctx, status, err)
+		if !retry || attempt >= p.Retries {
+			if ctx.Err() == nil {
+				us.record(originOf(url), retry, p.BreakerFailures, p.BreakerCooldown)
+			}
+			return orig, respHeader, status, err
+		}
+
+		us.addStat(&us.stats.Retries, 1)
+
+		// Wait between half and all of the backoff, doubling each time.
+		backoff := p.RetryBackoff << attempt
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable returns true if a fetch's failure might not happen again.
+func retryable(ctx context.Context, status int, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, ErrOriginalTooBig) && !errors.Is(err, format.ErrUnknownFormat)
+	}
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
@@ -0,0 +1,120 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/die-net/fotomat/v2/format"
+)
+
+func TestUpstreamsBreaker(t *testing.T) {
+	var us upstreams
+	const origin = "http://example.com"
+
+	s := us.acquire(origin, 0)
+	now := time.Now()
+	assert.True(t, us.allow(s, now))
+
+	// A success resets the count of consecutive failures.
+	us.record(origin, true, 2, time.Minute)
+	us.record(origin, false, 2, time.Minute)
+	us.record(origin, true, 2, time.Minute)
+	assert.True(t, us.allow(s, now))
+
+	// Enough failures in a row open the breaker until its cooldown.
+	us.record(origin, true, 2, time.Minute)
+	assert.False(t, us.allow(s, now))
+	assert.False(t, us.allow(s, now.Add(59*time.Second)))
+	assert.True(t, us.allow(s, now.Add(61*time.Second)))
+
+	// The origin's state outlives the request while it is failing.
+	us.release(origin, s)
+	assert.Equal(t, s, us.acquire(origin, 0))
+	us.release(origin, s)
+
+	stats := us.stats
+	assert.Equal(t, int64(1), stats.BreakerTrips)
+	assert.Equal(t, int64(2), stats.BreakerRejects)
+
+	// And is forgotten once it succeeds.
+	us.record(origin, false, 2, time.Minute)
+	s = us.acquire(origin, 0)
+	us.release(origin, s)
+	assert.Empty(t, us.states)
+
+	// Failures are ignored if the breaker is disabled.
+	us.record(origin, true, 0, time.Minute)
+	assert.Empty(t, us.states)
+}
+
+func TestUpstreamsWait(t *testing.T) {
+	var us upstreams
+	const origin = "http://example.com"
+
+	// Without a limit, there's never a wait.
+	s := us.acquire(origin, 0)
+	assert.True(t, us.wait(context.Background(), s, nil))
+	us.done(s)
+	us.release(origin, s)
+
+	s1 := us.acquire(origin, 1)
+	s2 := us.acquire(origin, 1)
+	assert.Equal(t, s1, s2)
+	assert.True(t, us.wait(context.Background(), s1, nil))
+
+	// A second fetch waits until the first is done, or gives up.
+	timeout := time.NewTimer(10 * time.Millisecond)
+	defer timeout.Stop()
+	assert.False(t, us.wait(context.Background(), s2, timeout.C))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, us.wait(ctx, s2, nil))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		us.done(s1)
+	}()
+	assert.True(t, us.wait(context.Background(), s2, nil))
+	us.done(s2)
+
+	assert.Equal(t, int64(3), us.stats.LimitWaits)
+
+	// Other origins have their own limit.
+	s3 := us.acquire("http://example.net", 1)
+	assert.True(t, us.wait(context.Background(), s3, nil))
+	us.done(s3)
+	us.release("http://example.net", s3)
+
+	us.release(origin, s1)
+	us.release(origin, s2)
+	assert.Empty(t, us.states)
+}
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	assert.True(t, retryable(ctx, 0, errors.New("connection refused")))
+	assert.True(t, retryable(ctx, http.StatusServiceUnavailable, nil))
+	assert.True(t, retryable(ctx, http.StatusBadGateway, nil))
+	assert.True(t, retryable(ctx, http.StatusGatewayTimeout, nil))
+	assert.False(t, retryable(ctx, http.StatusOK, nil))
+	assert.False(t, retryable(ctx, http.StatusNotFound, nil))
+	assert.False(t, retryable(ctx, http.StatusInternalServerError, nil))
+	assert.False(t, retryable(ctx, 0, ErrOriginalTooBig))
+	assert.False(t, retryable(ctx, 0, format.ErrUnknownFormat))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.False(t, retryable(canceled, 0, context.Canceled))
+}
+
+func TestOriginOf(t *testing.T) {
+	assert.Equal(t, "http://example.com", originOf("http://example.com/a/b.jpg?c=d"))
+	assert.Equal(t, "s3://bucket", originOf("s3://bucket/key.jpg"))
+	assert.Equal(t, "", originOf("%zz"))
+}
@@ -1,6 +1,8 @@
 package thumbnail
 
 import (
+	"math"
+
 	"github.com/die-net/fotomat/v2/vips"
 )
 
@@ -31,6 +33,30 @@ func scaleAspect(ow, oh, rw, rh int, within bool) (int, int, bool) {
 	return rw, rh, trustWidth
 }
 
+// aspectDimension returns the width (or height) in proportion to the
+// other dimension, given the original size, rounded up and limited to
+// maxDimension.
+func aspectDimension(size, otherSize, other int) int {
+	d := (size*other + otherSize - 1) / otherSize
+	if d > maxDimension {
+		d = maxDimension
+	}
+	return d
+}
+
+// focusOffset returns the offset of a crop of size out that centres it on
+// focus, a fraction of size in, while keeping the crop within in.
+func focusOffset(focus float64, out, in int) int {
+	offset := int(math.Round(focus*float64(in) - float64(out)/2))
+	if offset > in-out {
+		offset = in - out
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset
+}
+
 func preShrinkFactor(mw, mh, iw, ih int, trustWidth, jpeg bool) int {
 	// JPEG shrink on VIPS >= 8.6.4 and WebP shrink both round down the
 	// number of pixels.  Round our shrink factor down by a pixel to
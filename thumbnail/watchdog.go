@@ -0,0 +1,174 @@
+package thumbnail
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/die-net/fotomat/v2/vips"
+)
+
+// ErrProcessingTimeout is returned when Thumbnail was aborted for taking
+// longer than Options.MaxProcessingDuration.
+var ErrProcessingTimeout = errors.New("image processing took too long")
+
+const (
+	// DefaultAbortGracePeriod is used when Options.AbortGracePeriod is
+	// unspecified.
+	DefaultAbortGracePeriod = 2 * time.Minute
+	// DefaultMaxStuck is used when Options.MaxStuck is unspecified.
+	DefaultMaxStuck = 3
+	// DefaultStuckWindow is used when Options.StuckWindow is
+	// unspecified.
+	DefaultStuckWindow = 30 * time.Minute
+)
+
+// AbortStats counts Thumbnail operations stopped for taking longer than
+// Options.MaxProcessingDuration.
+type AbortStats struct {
+	// Aborted counts operations that were aborted.
+	Aborted int64
+	// Escalated counts aborted operations that were still running
+	// after Options.AbortGracePeriod.
+	Escalated int64
+}
+
+var (
+	abortStats AbortStats
+
+	// stuckMu protects stuck, the times that aborted operations were
+	// found still running, oldest first.
+	stuckMu sync.Mutex
+	stuck   []time.Time
+
+	// afterFunc, timeNow, logf, and fatalf are replaced by tests.
+	afterFunc = func(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+	timeNow   = time.Now
+	logf      = log.Printf
+	fatalf    = log.Fatalf
+)
+
+// timer is the part of *time.Timer that a watchdog uses.
+type timer interface {
+	Stop() bool
+}
+
+// Aborts returns how many Thumbnail operations have been aborted so far.
+func Aborts() AbortStats {
+	return AbortStats{
+		Aborted:   atomic.LoadInt64(&abortStats.Aborted),
+		Escalated: atomic.LoadInt64(&abortStats.Escalated),
+	}
+}
+
+// watchdog sets kill once an operation has run for limit.  If the
+// operation is still running grace later, the kill didn't take, and the
+// operation is counted as stuck.  Once maxStuck operations have been
+// stuck within window, VIPS is assumed to be broken, and the process
+// exits.
+type watchdog struct {
+	mu       sync.Mutex
+	kill     *vips.Kill
+	limit    time.Duration
+	grace    time.Duration
+	maxStuck int
+	window   time.Duration
+	timers   []timer
+	expired  bool
+	stopped  bool
+}
+
+func startWatchdog(kill *vips.Kill, o Options) *watchdog {
+	w := &watchdog{
+		kill:     kill,
+		limit:    o.MaxProcessingDuration,
+		grace:    o.AbortGracePeriod,
+		maxStuck: o.MaxStuck,
+		window:   o.StuckWindow,
+	}
+	if w.grace <= 0 {
+		w.grace = DefaultAbortGracePeriod
+	}
+	if w.maxStuck <= 0 {
+		w.maxStuck = DefaultMaxStuck
+	}
+	if w.window <= 0 {
+		w.window = DefaultStuckWindow
+	}
+
+	w.after(w.limit, w.expire)
+	return w
+}
+
+// after calls f after d, unless w is stopped first.
+func (w *watchdog) after(d time.Duration, f func()) {
+	t := afterFunc(d, f)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		t.Stop()
+		return
+	}
+	w.timers = append(w.timers, t)
+}
+
+func (w *watchdog) expire() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.expired = true
+	w.mu.Unlock()
+
+	atomic.AddInt64(&abortStats.Aborted, 1)
+	w.kill.Set()
+	w.after(w.grace, w.escalate)
+}
+
+func (w *watchdog) escalate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return
+	}
+
+	atomic.AddInt64(&abortStats.Escalated, 1)
+	if n := addStuck(timeNow(), w.window); n >= w.maxStuck {
+		fatalf("Thumbnail still running %v after being aborted for taking longer than %v, %d times in %v", w.grace, w.limit, n, w.window)
+	} else {
+		logf("Thumbnail still running %v after being aborted for taking longer than %v", w.grace, w.limit)
+	}
+}
+
+// addStuck records that an operation was found stuck at now, and returns
+// how many have been within window of then.
+func addStuck(now time.Time, window time.Duration) int {
+	stuckMu.Lock()
+	defer stuckMu.Unlock()
+
+	stuck = append(stuck, now)
+	for len(stuck) > 0 && now.Sub(stuck[0]) >= window {
+		stuck = stuck[1:]
+	}
+	return len(stuck)
+}
+
+// stop stops w, and returns true if it aborted the operation.
+func (w *watchdog) stop() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	for _, t := range w.timers {
+		t.Stop()
+	}
+	w.timers = nil
+
+	return w.expired
+}
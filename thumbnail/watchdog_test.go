@@ -0,0 +1,200 @@
+package thumbnail
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/die-net/fotomat/v2/vips"
+)
+
+func TestWatchdog(t *testing.T) {
+	clock := fakeClock(t)
+
+	kill := vips.NewKill()
+	defer kill.Free()
+
+	// An operation that finishes in time isn't aborted.
+	before := Aborts()
+	o := Options{MaxProcessingDuration: time.Minute, AbortGracePeriod: time.Hour}
+	w := startWatchdog(kill, o)
+	assert.Equal(t, []time.Duration{time.Minute}, clock.pending())
+	assert.False(t, w.stop())
+	assert.Empty(t, clock.pending())
+	assert.False(t, kill.IsSet())
+	assert.Equal(t, before, Aborts())
+
+	// One that doesn't is, and has the grace period to stop.
+	w = startWatchdog(kill, o)
+	clock.fire()
+	assert.True(t, kill.IsSet())
+	assert.Equal(t, []time.Duration{time.Hour}, clock.pending())
+	assert.True(t, w.stop())
+	assert.Empty(t, clock.pending())
+	after := Aborts()
+	assert.Equal(t, before.Aborted+1, after.Aborted)
+	assert.Equal(t, before.Escalated, after.Escalated)
+	assert.Empty(t, clock.logged)
+	assert.Empty(t, clock.fatal)
+
+	// If it's still running after that, it is only logged.
+	o.AbortGracePeriod = 0
+	stuck := func() {
+		w := startWatchdog(kill, o)
+		clock.fire()
+		assert.Equal(t, []time.Duration{DefaultAbortGracePeriod}, clock.pending())
+		clock.fire()
+		assert.True(t, w.stop())
+	}
+	stuck()
+	assert.Len(t, clock.logged, 1)
+	assert.Empty(t, clock.fatal)
+	after = Aborts()
+	assert.Equal(t, before.Aborted+2, after.Aborted)
+	assert.Equal(t, before.Escalated+1, after.Escalated)
+
+	// Once StuckWindow has passed, that no longer counts.
+	clock.now = clock.now.Add(DefaultStuckWindow)
+	for i := 1; i < DefaultMaxStuck; i++ {
+		stuck()
+	}
+	assert.Len(t, clock.logged, DefaultMaxStuck)
+	assert.Empty(t, clock.fatal)
+
+	// But MaxStuck within StuckWindow exits the process.
+	clock.now = clock.now.Add(DefaultStuckWindow - time.Second)
+	stuck()
+	assert.Len(t, clock.logged, DefaultMaxStuck)
+	assert.Len(t, clock.fatal, 1)
+	after = Aborts()
+	assert.Equal(t, before.Escalated+int64(DefaultMaxStuck)+1, after.Escalated)
+
+	// As does a lower MaxStuck.
+	clock.now = clock.now.Add(DefaultStuckWindow)
+	o.MaxStuck = 1
+	stuck()
+	assert.Len(t, clock.fatal, 2)
+}
+
+func TestProcessingTimeout(t *testing.T) {
+	clock := fakeClock(t)
+	clock.immediate = time.Minute
+
+	_, err := Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 200, MaxProcessingDuration: time.Minute})
+	assert.Equal(t, ErrProcessingTimeout, err)
+	assert.Empty(t, clock.pending())
+	assert.Empty(t, clock.fatal)
+
+	// Later operations aren't affected.
+	clock.immediate = 0
+	thumb, err := Thumbnail(image("watermelon.jpg"), Options{Width: 200, Height: 200, MaxProcessingDuration: time.Minute})
+	assert.Nil(t, err)
+	assert.NotNil(t, thumb)
+	assert.Empty(t, clock.pending())
+}
+
+// testClock replaces afterFunc, timeNow, logf, and fatalf, so that timers
+// only fire when told to, time only passes when now is changed, and the
+// process doesn't exit.
+type testClock struct {
+	mu     sync.Mutex
+	timers []*testTimer
+	now    time.Time
+	logged []string
+	fatal  []string
+	// immediate is a duration whose timers fire as soon as they're
+	// started.
+	immediate time.Duration
+}
+
+type testTimer struct {
+	clock   *testClock
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func fakeClock(t *testing.T) *testClock {
+	c := &testClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	savedAfterFunc, savedTimeNow, savedLogf, savedFatalf := afterFunc, timeNow, logf, fatalf
+	t.Cleanup(func() { afterFunc, timeNow, logf, fatalf = savedAfterFunc, savedTimeNow, savedLogf, savedFatalf })
+
+	stuckMu.Lock()
+	savedStuck := stuck
+	stuck = nil
+	stuckMu.Unlock()
+	t.Cleanup(func() {
+		stuckMu.Lock()
+		stuck = savedStuck
+		stuckMu.Unlock()
+	})
+
+	afterFunc = func(d time.Duration, f func()) timer {
+		tt := &testTimer{clock: c, d: d, f: f}
+		if d == c.immediate {
+			tt.stopped = true
+			f()
+		}
+		c.mu.Lock()
+		c.timers = append(c.timers, tt)
+		c.mu.Unlock()
+		return tt
+	}
+	timeNow = func() time.Time { return c.now }
+	logf = func(format string, v ...interface{}) {
+		c.logged = append(c.logged, fmt.Sprintf(format, v...))
+	}
+	fatalf = func(format string, v ...interface{}) {
+		c.fatal = append(c.fatal, fmt.Sprintf(format, v...))
+	}
+
+	return c
+}
+
+// pending returns the durations of the timers that haven't fired or been
+// stopped.
+func (c *testClock) pending() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var d []time.Duration
+	for _, tt := range c.timers {
+		if !tt.stopped {
+			d = append(d, tt.d)
+		}
+	}
+	return d
+}
+
+// fire runs the oldest pending timer.
+func (c *testClock) fire() {
+	c.mu.Lock()
+	var next *testTimer
+	for _, tt := range c.timers {
+		if !tt.stopped {
+			next = tt
+			break
+		}
+	}
+	if next != nil {
+		next.stopped = true
+	}
+	c.mu.Unlock()
+
+	if next != nil {
+		next.f()
+	}
+}
+
+func (tt *testTimer) Stop() bool {
+	tt.clock.mu.Lock()
+	defer tt.clock.mu.Unlock()
+
+	wasPending := !tt.stopped
+	tt.stopped = true
+	return wasPending
+}
@@ -6,6 +6,10 @@ package vips
 */
 import "C"
 
+import (
+	"unsafe"
+)
+
 // Extend specifies how to extend edges of an image
 type Extend int
 
@@ -39,6 +43,24 @@ const (
 	DirectionVertical   Direction = C.VIPS_DIRECTION_VERTICAL   // top-bottom
 )
 
+// Interesting specifies how Smartcrop finds the most interesting part of
+// an image.
+type Interesting int
+
+// Various Interesting values understood by VIPS.
+const (
+	InterestingCentre    Interesting = C.VIPS_INTERESTING_CENTRE    // the middle of the image
+	InterestingEntropy   Interesting = C.VIPS_INTERESTING_ENTROPY   // the part with the most detail
+	InterestingAttention Interesting = C.VIPS_INTERESTING_ATTENTION // features likely to draw human attention
+)
+
+// AddAlpha appends an opaque alpha channel to in.
+func (in *Image) AddAlpha() error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_addalpha(in.vi, &out)
+	return in.imageError(out, e)
+}
+
 // Cast converts in to BandFormat. Floats are truncated (not rounded). Out of range values are clipped.
 func (in *Image) Cast(format BandFormat) error {
 	var out *C.struct__VipsImage
@@ -61,6 +83,16 @@ func (in *Image) Embed(left, top, width, height int, extend Extend) error {
 	return in.imageError(out, e)
 }
 
+// EmbedBackground embeds in within an image of size width by height at
+// position left, top, filling the new pixels with background, which has a
+// value for each band.  Every page of a multi-page image, such as the
+// frames of an animation, is embedded the same way.
+func (in *Image) EmbedBackground(left, top, width, height int, background []float64) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_embed_background(in.vi, &out, C.int(left), C.int(top), C.int(width), C.int(height), (*C.double)(unsafe.Pointer(&background[0])), C.int(len(background)))
+	return in.imageError(out, e)
+}
+
 // ExtractArea extract an area from an image. The area must fit within in.
 func (in *Image) ExtractArea(left, top, width, height int) error {
 	var out *C.struct__VipsImage
@@ -68,6 +100,15 @@ func (in *Image) ExtractArea(left, top, width, height int) error {
 	return in.imageError(out, e)
 }
 
+// ExtractAreaPages extracts the same area from every page of a multi-page
+// image, such as the frames of an animation, and joins them back together.
+// The area must fit within a single page.
+func (in *Image) ExtractAreaPages(left, top, width, height int) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_extract_area_pages(in.vi, &out, C.int(left), C.int(top), C.int(width), C.int(height))
+	return in.imageError(out, e)
+}
+
 // ExtractBand extracts band (channel) number n from in.  Extracting out of range is an error.
 func (in *Image) ExtractBand(band, n int) error {
 	var out *C.struct__VipsImage
@@ -109,6 +150,14 @@ func (in *Image) Rot(angle Angle) error {
 	return in.imageError(out, e)
 }
 
+// Smartcrop crops in to width by height, keeping the part of the image
+// that interesting picks.
+func (in *Image) Smartcrop(width, height int, interesting Interesting) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_smartcrop(in.vi, &out, C.int(width), C.int(height), C.VipsInteresting(interesting))
+	return in.imageError(out, e)
+}
+
 // Unpremultiply any alpha channel. The final band is taken to be the alpha.
 func (in *Image) Unpremultiply() error {
 	var out *C.struct__VipsImage
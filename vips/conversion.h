@@ -2,6 +2,11 @@
 #include <vips/vips.h>
 #include <vips/vips7compat.h>
 
+int
+cgo_vips_addalpha(VipsImage *in, VipsImage **out) {
+    return vips_addalpha(in, out, NULL);
+}
+
 int
 cgo_vips_cast(VipsImage *in, VipsImage **out, VipsBandFormat format) {
     return vips_cast(in, out, format, NULL);
@@ -17,11 +22,71 @@ cgo_vips_embed(VipsImage *in, VipsImage **out, int left, int top, int width, int
     return vips_embed(in, out, left, top, width, height, "extend", extend, NULL);
 }
 
+int
+cgo_vips_embed_background(VipsImage *in, VipsImage **out, int left, int top, int width, int height, double *background, int n) {
+    VipsArrayDouble *bg = vips_array_double_new(background, n);
+    int page_height = vips_image_get_page_height(in);
+    int n_pages = in->Ysize / page_height;
+    VipsObject *context;
+    VipsImage **pages;
+    int i, e = 0;
+
+    if (n_pages <= 1) {
+        e = vips_embed(in, out, left, top, width, height, "extend", VIPS_EXTEND_BACKGROUND, "background", bg, NULL);
+        vips_area_unref(VIPS_AREA(bg));
+        return e;
+    }
+
+    context = VIPS_OBJECT(vips_image_new());
+    pages = (VipsImage **) vips_object_local_array(context, 2 * n_pages);
+    for (i = 0; i < n_pages && !e; i++) {
+        e = vips_extract_area(in, &pages[i], 0, i * page_height, in->Xsize, page_height, NULL) ||
+            vips_embed(pages[i], &pages[n_pages + i], left, top, width, height, "extend", VIPS_EXTEND_BACKGROUND, "background", bg, NULL);
+    }
+
+    if (!e)
+        e = vips_arrayjoin(pages + n_pages, out, n_pages, "across", 1, NULL);
+    if (!e)
+        vips_image_set_int(*out, VIPS_META_PAGE_HEIGHT, height);
+
+    vips_area_unref(VIPS_AREA(bg));
+    g_object_unref(context);
+    return e ? -1 : 0;
+}
+
 int
 cgo_vips_extract_area(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
     return vips_extract_area(in, out, left, top, width, height, NULL);
 }
 
+int
+cgo_vips_extract_area_pages(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
+    int page_height = vips_image_get_page_height(in);
+    int n_pages = in->Ysize / page_height;
+    VipsObject *context;
+    VipsImage **pages;
+    int i, e;
+
+    if (n_pages <= 1)
+        return vips_extract_area(in, out, left, top, width, height, NULL);
+
+    context = VIPS_OBJECT(vips_image_new());
+    pages = (VipsImage **) vips_object_local_array(context, n_pages);
+    for (i = 0; i < n_pages; i++) {
+        if (vips_extract_area(in, &pages[i], left, i * page_height + top, width, height, NULL)) {
+            g_object_unref(context);
+            return -1;
+        }
+    }
+
+    e = vips_arrayjoin(pages, out, n_pages, "across", 1, NULL);
+    if (!e)
+        vips_image_set_int(*out, VIPS_META_PAGE_HEIGHT, height);
+
+    g_object_unref(context);
+    return e;
+}
+
 int
 cgo_vips_extract_band(VipsImage *in, VipsImage **out, int band, int n) {
     return vips_extract_band(in, out, band, "n", n, NULL);
@@ -60,6 +125,11 @@ cgo_vips_rot(VipsImage *in, VipsImage **out, VipsAngle angle) {
     return vips_rot(in, out, angle, NULL);
 }
 
+int
+cgo_vips_smartcrop(VipsImage *in, VipsImage **out, int width, int height, VipsInteresting interesting) {
+    return vips_smartcrop(in, out, width, height, "interesting", interesting, NULL);
+}
+
 int
 cgo_vips_unpremultiply(VipsImage *in, VipsImage **out) {
     // Assumes we're converting to uchar and uses default max_alpha of 255.
@@ -0,0 +1,50 @@
+package vips
+
+/*
+#cgo pkg-config: vips
+#include "eval.h"
+*/
+import "C"
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Kill is a flag that can be set from any goroutine to stop the
+// evaluation of the images watching it, as vips_image_set_kill() does.
+// Must be created with NewKill, and freed with Free.
+type Kill struct {
+	// flag is a C gint, so that VIPS can read it from its own threads.
+	flag unsafe.Pointer
+}
+
+// NewKill allocates an unset Kill.
+func NewKill() *Kill {
+	return &Kill{flag: C.calloc(1, C.sizeof_gint)}
+}
+
+// Set makes the evaluation of every image watching k fail.
+func (k *Kill) Set() {
+	atomic.StoreInt32((*int32)(k.flag), 1)
+}
+
+// IsSet returns true if Set has been called.
+func (k *Kill) IsSet() bool {
+	return atomic.LoadInt32((*int32)(k.flag)) != 0
+}
+
+// Free frees the memory associated with a Kill.  Every image watching it
+// must have been closed first.
+func (k *Kill) Free() {
+	C.free(k.flag)
+	*k = Kill{}
+}
+
+// SetKill makes evaluation of the image, and of every image made from it
+// afterwards, fail once k is set.  Evaluation checks k between tiles, so
+// an image stops soon after, unless it is stuck inside a single VIPS
+// operation.
+func (in *Image) SetKill(k *Kill) {
+	C.cgo_vips_image_set_kill(in.vi, (*C.gint)(k.flag))
+}
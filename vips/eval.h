@@ -0,0 +1,16 @@
+#include <stdlib.h>
+#include <vips/vips.h>
+#include <vips/vips7compat.h>
+
+static void
+cgo_vips_kill_eval(VipsImage *image, VipsProgress *progress, gint *kill) {
+    // Kill the image being evaluated, which may be downstream of image.
+    if (g_atomic_int_get(kill))
+        vips_image_set_kill(progress->im, TRUE);
+}
+
+void
+cgo_vips_image_set_kill(VipsImage *image, gint *kill) {
+    vips_image_set_progress(image, TRUE);
+    g_signal_connect(image, "eval", G_CALLBACK(cgo_vips_kill_eval), kill);
+}
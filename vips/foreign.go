@@ -10,6 +10,16 @@ import (
 	"unsafe"
 )
 
+// HeifCompression is the codec used to compress an image within a HEIF
+// container.
+type HeifCompression int
+
+// Various HeifCompression values understood by VIPS.
+const (
+	HeifCompressionHevc HeifCompression = C.VIPS_FOREIGN_HEIF_COMPRESSION_HEVC // HEIC, as used by iPhones
+	HeifCompressionAv1  HeifCompression = C.VIPS_FOREIGN_HEIF_COMPRESSION_AV1  // AVIF
+)
+
 // Gifload reads a GIF file into an Image.
 func Gifload(filename string) (*Image, error) {
 	var out *C.struct__VipsImage
@@ -19,13 +29,74 @@ func Gifload(filename string) (*Image, error) {
 	return loadError(out, e)
 }
 
-// GifloadBuffer reads a GIF byte slice into an Image.
+// GifloadBuffer reads the first frame of a GIF byte slice into an Image.
 func GifloadBuffer(buf []byte) (*Image, error) {
 	var out *C.struct__VipsImage
-	e := C.cgo_vips_gifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out)
+	e := C.cgo_vips_gifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, 1)
+	return loadError(out, e)
+}
+
+// GifloadBufferAnimated reads every frame of a GIF byte slice into an
+// Image, with the frames stacked vertically and ImageGetPageHeight set to
+// the height of one frame.
+func GifloadBufferAnimated(buf []byte) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_gifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, -1)
+	return loadError(out, e)
+}
+
+// GifsaveBuffer writes an Image to a GIF byte slice.  An Image with
+// several pages is saved as an animation, using its frame delays and loop
+// count.
+func (in *Image) GifsaveBuffer() ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	e := C.cgo_vips_gifsave_buffer(in.vi, &ptr, &length)
+
+	return saveError(ptr, length, e)
+}
+
+// Heifload reads a HEIF or AVIF file into an Image.
+func Heifload(filename string) (*Image, error) {
+	var out *C.struct__VipsImage
+	cf := C.CString(filename)
+	e := C.cgo_vips_heifload(cf, &out)
+	C.free(unsafe.Pointer(cf))
 	return loadError(out, e)
 }
 
+// HeifloadBuffer reads a HEIF or AVIF byte slice into an Image.
+func HeifloadBuffer(buf []byte) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_heifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, 1)
+	return loadError(out, e)
+}
+
+// HeifloadBufferShrink reads a HEIF or AVIF byte slice into an Image.  If
+// the file has an embedded thumbnail that is no smaller than 1/shrink of
+// the full image's width and height, it is loaded instead, which is much
+// faster than decompressing the whole image and then resizing later.
+func HeifloadBufferShrink(buf []byte, shrink int) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_heifload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(shrink))
+	return loadError(out, e)
+}
+
+// HeifsaveBuffer writes an Image to a HEIF byte slice.
+// Q specifies the compression factor between 1 and 100.
+// Lossless encodes the image without any loss, at a large file size.
+// Compression selects the codec, such as HEVC for HEIC or AV1 for AVIF.
+// Effort trades CPU time for a smaller file, from 0 (fastest) to 9.
+func (in *Image) HeifsaveBuffer(q int, lossless bool, compression HeifCompression, effort int) ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+
+	e := C.cgo_vips_heifsave_buffer(in.vi, &ptr, &length, C.int(q), C.int(btoi(lossless)), C.VipsForeignHeifCompression(compression), C.int(effort))
+
+	return saveError(ptr, length, e)
+}
+
 // Pdfload reads a PDF file into an Image at 72 dpi.
 func Pdfload(filename string) (*Image, error) {
 	var out *C.struct__VipsImage
@@ -199,10 +270,19 @@ func WebploadShrink(filename string, shrink int) (*Image, error) {
 	return loadError(out, e)
 }
 
-// WebploadBuffer read a WebP byte slice into an Image.
+// WebploadBuffer read the first frame of a WebP byte slice into an Image.
 func WebploadBuffer(buf []byte) (*Image, error) {
 	var out *C.struct__VipsImage
-	e := C.cgo_vips_webpload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, 1)
+	e := C.cgo_vips_webpload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, 1, 1)
+	return loadError(out, e)
+}
+
+// WebploadBufferAnimated reads every frame of a WebP byte slice into an
+// Image, with the frames stacked vertically and ImageGetPageHeight set to
+// the height of one frame.
+func WebploadBufferAnimated(buf []byte) (*Image, error) {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_webpload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, 1, -1)
 	return loadError(out, e)
 }
 
@@ -211,11 +291,13 @@ func WebploadBuffer(buf []byte) (*Image, error) {
 // much faster than decompressing the whole image and then resizing later.
 func WebploadBufferShrink(buf []byte, shrink int) (*Image, error) {
 	var out *C.struct__VipsImage
-	e := C.cgo_vips_webpload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(shrink))
+	e := C.cgo_vips_webpload_buffer(unsafe.Pointer(&buf[0]), C.size_t(len(buf)), &out, C.int(shrink), 1)
 	return loadError(out, e)
 }
 
-// WebpsaveBuffer writes an Image to a WebP byte slice.
+// WebpsaveBuffer writes an Image to a WebP byte slice.  An Image with
+// several pages is saved as an animation, using its frame delays and loop
+// count.
 // Q specifies the compression factor for RGB channels between 0 and 100.
 // Lossless encodes the image without any loss, at a large file size.
 func (in *Image) WebpsaveBuffer(q int, lossless bool) ([]byte, error) {
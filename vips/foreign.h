@@ -8,8 +8,57 @@ cgo_vips_gifload(const char *filename, VipsImage **out) {
 }
 
 int
-cgo_vips_gifload_buffer(void *buf, size_t len, VipsImage **out) {
-    return vips_gifload_buffer(buf, len, out, NULL);
+cgo_vips_gifload_buffer(void *buf, size_t len, VipsImage **out, int n) {
+    return vips_gifload_buffer(buf, len, out, "n", n, NULL);
+}
+
+int
+cgo_vips_gifsave_buffer(VipsImage *in, void **buf, size_t *len) {
+    return vips_gifsave_buffer(in, buf, len, "strip", TRUE, NULL);
+}
+
+/* libheif applies any rotation and mirroring itself, so drop the EXIF
+ * orientation to keep it from being applied a second time. */
+static int
+cgo_vips_heif_orientation(VipsImage *out) {
+    vips_image_remove(out, "exif-ifd0-Orientation");
+    return 0;
+}
+
+int
+cgo_vips_heifload(const char *filename, VipsImage **out) {
+    if (vips_heifload(filename, out, NULL))
+        return -1;
+    return cgo_vips_heif_orientation(*out);
+}
+
+int
+cgo_vips_heifload_buffer(void *buf, size_t len, VipsImage **out, int shrink) {
+    VipsImage *full, *thumb;
+
+    if (vips_heifload_buffer(buf, len, &full, NULL))
+        return -1;
+
+    /* Use the embedded thumbnail if it is at least 1/shrink of the size
+     * of the full image. */
+    if (shrink > 1) {
+        if (vips_heifload_buffer(buf, len, &thumb, "thumbnail", TRUE, NULL)) {
+            vips_error_clear();
+        } else if (thumb->Xsize * shrink >= full->Xsize && thumb->Ysize * shrink >= full->Ysize) {
+            g_object_unref(full);
+            full = thumb;
+        } else {
+            g_object_unref(thumb);
+        }
+    }
+
+    *out = full;
+    return cgo_vips_heif_orientation(*out);
+}
+
+int
+cgo_vips_heifsave_buffer(VipsImage *in, void **buf, size_t *len, int q, int lossless, VipsForeignHeifCompression compression, int effort) {
+    return vips_heifsave_buffer(in, buf, len, "strip", TRUE, "Q", q, "lossless", lossless, "compression", compression, "effort", effort, NULL);
 }
 
 int
@@ -78,8 +127,8 @@ cgo_vips_webpload(const char *filename, VipsImage **out, int shrink) {
 }
 
 int
-cgo_vips_webpload_buffer(void *buf, size_t len, VipsImage **out, int shrink) {
-    return vips_webpload_buffer(buf, len, out, "shrink", shrink, NULL);
+cgo_vips_webpload_buffer(void *buf, size_t len, VipsImage **out, int shrink, int n) {
+    return vips_webpload_buffer(buf, len, out, "shrink", shrink, "n", n, NULL);
 }
 
 int
@@ -68,6 +68,26 @@ func (in *Image) ImageGetBandFormat() BandFormat {
 	return BandFormat(C.vips_image_get_format(in.vi))
 }
 
+// ImageGetPageHeight returns the height of each page of a multi-page
+// image, such as the frames of an animation, or Ysize if it only has one.
+func (in *Image) ImageGetPageHeight() int {
+	return int(C.vips_image_get_page_height(in.vi))
+}
+
+// ImageGetNPages returns the number of pages in the file an image was
+// loaded from, even if only some of them were loaded.
+func (in *Image) ImageGetNPages() int {
+	return int(C.vips_image_get_n_pages(in.vi))
+}
+
+// SetPageHeight sets the height of each page of a multi-page image.  It
+// is ignored unless it evenly divides Ysize.
+func (in *Image) SetPageHeight(height int) error {
+	var out *C.struct__VipsImage
+	e := C.cgo_vips_set_page_height(in.vi, &out, C.int(height))
+	return in.imageError(out, e)
+}
+
 // ImageGuessInterpretation returns the Interpretation for an image,
 // guessing a sane value if the set value looks crazy.
 func (in *Image) ImageGuessInterpretation() Interpretation {
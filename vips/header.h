@@ -9,3 +9,11 @@ cgo_vips_image_get_as_string(const VipsImage *image, const char *field, const ch
     }
     return -1;
 }
+
+int
+cgo_vips_set_page_height(VipsImage *in, VipsImage **out, int page_height) {
+    if (vips_copy(in, out, NULL))
+        return -1;
+    vips_image_set_int(*out, VIPS_META_PAGE_HEIGHT, page_height);
+    return 0;
+}
@@ -12,6 +12,7 @@ import "C"
 import (
 	"os"
 	"runtime"
+	"unsafe"
 )
 
 // Initialize starts up the world of VIPS. You should call this on program
@@ -32,6 +33,18 @@ func Initialize() {
 	C.vips_cache_set_max(0)
 }
 
+// HasOperation reports whether VIPS has the operation with the given
+// nickname, such as "heifsave_buffer".  Some loaders and savers are only
+// present if VIPS was built with an optional library.
+func HasOperation(nickname string) bool {
+	cb := C.CString("VipsOperation")
+	cn := C.CString(nickname)
+	t := C.vips_type_find(cb, cn)
+	C.free(unsafe.Pointer(cn))
+	C.free(unsafe.Pointer(cb))
+	return t != 0
+}
+
 // LeakSet turns leak checking on or off.  You should call this very early
 // in your program.
 func LeakSet(enable bool) {